@@ -2,6 +2,7 @@ package cloudstorage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"mime"
 	"os"
@@ -11,12 +12,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-
-	// "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/knadh/koanf/v2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"hangout.com/core/storage-service/exceptions"
 	"hangout.com/core/storage-service/files"
 	"hangout.com/core/storage-service/logger"
 )
@@ -72,7 +73,10 @@ func checkAndCreateBucket(ctx context.Context, client *s3.Client, bucket string,
 		log.Error(ctx, "Error checking bucket", "bucket", bucket, "error", err, "worker-id", workerId)
 	}
 }
-func Download(ctx context.Context, s3Client *s3.Client, file *files.File, cfg *koanf.Koanf, log logger.Log) {
+
+// Download fetches the uploaded file into the workspace of the job. A file that is missing from the upload bucket
+// is a permanent failure. The file is only written once the workspace admitted its size.
+func Download(ctx context.Context, s3Client *s3.Client, file *files.File, cfg *koanf.Koanf, log logger.Log) error {
 	tr := otel.Tracer("hangout.storage.cloudstorage")
 	ctx, span := tr.Start(ctx, "DownloadFile")
 	defer span.End()
@@ -85,7 +89,7 @@ func Download(ctx context.Context, s3Client *s3.Client, file *files.File, cfg *k
 	log.Info(ctx, "Downloading file from S3", "file", file.Filename)
 
 	downloadBucket := cfg.String("aws.s3.upload-bucket")
-	outputPath := "/tmp/" + file.Filename
+	outputPath := file.Workspace.Source()
 
 	out, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(downloadBucket),
@@ -95,15 +99,28 @@ func Download(ctx context.Context, s3Client *s3.Client, file *files.File, cfg *k
 		log.Error(ctx, "Error while downloading file", "file", file.Filename, "error", err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return exceptions.NewPermanentStageError(exceptions.StageDownload, downloadBucket+"/"+file.Filename, err)
+		}
+		return exceptions.NewStageError(exceptions.StageDownload, downloadBucket+"/"+file.Filename, err)
 	}
 	defer out.Body.Close()
 
+	err = file.Workspace.Admit(aws.ToInt64(out.ContentLength))
+	if err != nil {
+		log.Warn(ctx, "Not enough disk space for the file", "file", file.Filename, "size", aws.ToInt64(out.ContentLength), "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
 	f, err := os.Create(outputPath)
 	if err != nil {
 		log.Error(ctx, "Could not create local file", "path", outputPath, "error", err)
 		span.RecordError(err)
-		return
+		span.SetStatus(codes.Error, err.Error())
+		return exceptions.NewStageError(exceptions.StageDownload, outputPath, err)
 	}
 	defer f.Close()
 
@@ -111,13 +128,16 @@ func Download(ctx context.Context, s3Client *s3.Client, file *files.File, cfg *k
 	if err != nil {
 		log.Error(ctx, "Error saving file", "file", outputPath, "error", err)
 		span.RecordError(err)
-		return
+		span.SetStatus(codes.Error, err.Error())
+		return exceptions.NewStageError(exceptions.StageDownload, outputPath, err)
 	}
 
 	log.Info(ctx, "File downloaded successfully", "path", outputPath)
+	return nil
 }
 
-func UploadDir(ctx context.Context, s3Client *s3.Client, event *files.File, cfg *koanf.Koanf, log logger.Log) {
+// UploadDir uploads the output folder of the workspace of the file to the storage bucket
+func UploadDir(ctx context.Context, s3Client *s3.Client, event *files.File, cfg *koanf.Koanf, log logger.Log) error {
 	tr := otel.Tracer("hangout.storage.cloudstorage")
 	ctx, span := tr.Start(ctx, "UploadDir")
 	defer span.End()
@@ -127,8 +147,8 @@ func UploadDir(ctx context.Context, s3Client *s3.Client, event *files.File, cfg
 		attribute.Int("file.userId", int(event.UserId)),
 	)
 
-	baseFilename := strings.Split(event.Filename, ".")[0]
-	currentDir := "/tmp/" + baseFilename
+	baseFilename := event.KeyPrefix()
+	currentDir := event.Workspace.Output()
 	storageBucket := cfg.String("aws.s3.storage-bucket")
 
 	log.Info(ctx, "Starting to upload directory to S3", "directory", currentDir)
@@ -177,42 +197,32 @@ func UploadDir(ctx context.Context, s3Client *s3.Client, event *files.File, cfg
 
 	if err != nil {
 		log.Error(ctx, "Error walking the directory", "directory", currentDir, "error", err)
-	} else {
-		log.Info(ctx, "Folder uploaded successfully", "directory", currentDir)
-		span.SetStatus(codes.Ok, "Folder uploaded successfully")
-		log.Info(ctx, "Deleting the local directory", "directory", currentDir)
-		deleteUploadedDirFromLocal(ctx, event, log)
-	}
-}
-
-func deleteUploadedDirFromLocal(ctx context.Context, file *files.File, log logger.Log) {
-	tr := otel.Tracer("hangout.storage.cloudstorage")
-	ctx, span := tr.Start(ctx, "DeleteUploadedFiles")
-	defer span.End()
-
-	span.SetAttributes(
-		attribute.String("file.name", file.Filename),
-		attribute.Int("file.userId", int(file.UserId)),
-	)
-
-	baseFilename := strings.Split(file.Filename, ".")[0]
-	dirPath := "/tmp/" + baseFilename
-	err := os.RemoveAll(dirPath)
-	if err != nil {
-		log.Error(ctx, "Could not delete local directory", "directory", dirPath, "error", err)
 		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return exceptions.NewStageError(exceptions.StageUpload, storageBucket+"/"+baseFilename, err)
 	}
-	log.Info(ctx, "Local directory deleted successfully", "file", file.Filename, "directory", dirPath)
+	log.Info(ctx, "Folder uploaded successfully", "directory", currentDir)
+	span.SetStatus(codes.Ok, "Folder uploaded successfully")
+	return nil
 }
 
 func getContentType(extension string) string {
 	switch extension {
 	case ".mpd":
 		return "application/dash+xml"
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
 	case ".mp4":
 		return "video/mp4"
 	case ".m4s":
 		return "video/iso.segment"
+	case ".vtt":
+		return "text/vtt"
+	case ".m4a":
+		return "audio/mp4"
+	case ".webm":
+		// only audio is written as webm
+		return "audio/webm"
 	default:
 		return mime.TypeByExtension(extension) // Fallback to the standard MIME detection
 	}
@@ -25,6 +25,10 @@ func ConnectToDB(ctx context.Context, cfg *koanf.Koanf, log logger.Log) *Databas
 		exceptions.DbConnectionError(ctx, "could not connect to database", &err, log)
 	}
 	log.Info(ctx, "successfully connected to database")
+	err = migrate(ctx, dbConnPool, log)
+	if err != nil {
+		exceptions.DbConnectionError(ctx, "could not update database schema", &err, log)
+	}
 	return &DatabaseConnectionPool{pool: dbConnPool}
 }
 
@@ -21,29 +21,84 @@ func (dbConn *DatabaseConnectionPool) IsAlreadyProcessed(ctx context.Context, fi
 	return currentStatus == model.SUCCESS, nil
 }
 
-func (dbConn *DatabaseConnectionPool) UpdateProcessingStatus(ctx context.Context, filename string, processStatus model.ProcessStatus, log logger.Log) error {
+// UpdateProcessingStatus changes the process_status of the file. When an event is given it is written
+// to the outbox in the same transaction, so that the status change and its event are never out of sync.
+func (dbConn *DatabaseConnectionPool) UpdateProcessingStatus(ctx context.Context, filename string, processStatus model.ProcessStatus, event *OutboxMessage, log logger.Log) error {
 	tr := otel.Tracer("hangout.storage.database")
 	ctx, span := tr.Start(ctx, "UpdateProcessingStatus")
 	span.SetAttributes(
 		attribute.String("db.operation", "UPDATE"),
 		attribute.String("db.filename", filename),
 		attribute.String("db.process_status", string(processStatus)),
+		attribute.Bool("db.outbox", event != nil),
 	)
 	defer span.End()
 
-	query := `UPDATE media SET process_status = $1 where filename = $2`
-	cmdTag, err := dbConn.pool.Exec(ctx, query, processStatus, filename)
+	tx, err := dbConn.pool.Begin(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.Error(ctx, "could not start transaction to update file processing status", "error", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// a job starts over from no progress and is complete once it succeeded, any other status keeps the last progress
+	var progress *float64
+	switch processStatus {
+	case model.PROCESSING:
+		progress = new(float64)
+	case model.SUCCESS:
+		complete := 100.0
+		progress = &complete
+	}
+	query := `UPDATE media SET process_status = $1, progress_percent = COALESCE($3, progress_percent) where filename = $2`
+	cmdTag, err := tx.Exec(ctx, query, processStatus, filename, progress)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		log.Error(ctx, "could not update file processing status in database", "error", err)
+		return err
 	}
 	if cmdTag.RowsAffected() == 0 {
 		log.Error(ctx, "file not found for update", "filename", filename)
 	}
+	if event != nil {
+		err = insertOutboxMessage(ctx, tx, event)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			log.Error(ctx, "could not write status event to outbox", "error", err)
+			return err
+		}
+	}
+	err = tx.Commit(ctx)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.Error(ctx, "could not commit file processing status", "error", err)
 		return err
-	} else {
-		return nil
 	}
+	return nil
+}
+
+// UpdateProgress stores how far processing of the file has got in percent. The progress never goes back while the file is processed,
+// so that reports of encodes running side by side may arrive in any order.
+func (dbConn *DatabaseConnectionPool) UpdateProgress(ctx context.Context, filename string, percent float64) error {
+	tr := otel.Tracer("hangout.storage.database")
+	ctx, span := tr.Start(ctx, "UpdateProgress")
+	span.SetAttributes(
+		attribute.String("db.operation", "UPDATE"),
+		attribute.String("db.filename", filename),
+		attribute.Float64("db.progress_percent", percent),
+	)
+	defer span.End()
+
+	query := `UPDATE media SET progress_percent = GREATEST(progress_percent, $1) WHERE filename = $2 AND process_status = $3`
+	_, err := dbConn.pool.Exec(ctx, query, percent, filename, model.PROCESSING)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
 }
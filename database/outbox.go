@@ -0,0 +1,96 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// OutboxMessage is a kafka record that is stored in the same transaction as the change it announces
+// and published later by the outbox relay
+type OutboxMessage struct {
+	Id      int64
+	Topic   string
+	Key     string
+	Payload []byte
+	Headers map[string]string
+}
+
+func insertOutboxMessage(ctx context.Context, tx pgx.Tx, message *OutboxMessage) error {
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO outbox (topic, message_key, payload, headers) VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(ctx, query, message.Topic, message.Key, message.Payload, headers)
+	return err
+}
+
+// ClaimOutbox claims up to limit unsent outbox messages in insertion order for claimFor and returns them.
+// The claim is committed before the messages are published, so that no transaction stays open while kafka
+// is slow. Messages whose claim ran out, because the relay that claimed them stopped, are claimed again.
+func (dbConn *DatabaseConnectionPool) ClaimOutbox(ctx context.Context, limit int, claimFor time.Duration) ([]OutboxMessage, error) {
+	tr := otel.Tracer("hangout.storage.database")
+	ctx, span := tr.Start(ctx, "ClaimOutbox")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.operation", "UPDATE"),
+		attribute.Int("db.limit", limit),
+	)
+
+	query := `UPDATE outbox SET claimed_until = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < now())
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, topic, message_key, payload, headers`
+	rows, err := dbConn.pool.Query(ctx, query, limit, claimFor.Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	var claimed []OutboxMessage
+	for rows.Next() {
+		var message OutboxMessage
+		var headers []byte
+		if err = rows.Scan(&message.Id, &message.Topic, &message.Key, &message.Payload, &headers); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(headers, &message.Headers); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, message)
+	}
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	// UPDATE ... RETURNING does not keep the order of the sub query
+	slices.SortFunc(claimed, func(a, b OutboxMessage) int { return cmp.Compare(a.Id, b.Id) })
+	span.SetAttributes(attribute.Int("outbox.claimed", len(claimed)))
+	return claimed, nil
+}
+
+// MarkOutboxSent marks published outbox messages as sent
+func (dbConn *DatabaseConnectionPool) MarkOutboxSent(ctx context.Context, ids []int64) error {
+	_, err := dbConn.pool.Exec(ctx, `UPDATE outbox SET sent_at = now(), claimed_until = NULL WHERE id = ANY($1)`, ids)
+	return err
+}
+
+// ReleaseOutbox gives up the claim on outbox messages that were not published, so that the next
+// poll picks them up again without waiting for the claim to run out
+func (dbConn *DatabaseConnectionPool) ReleaseOutbox(ctx context.Context, ids []int64) error {
+	_, err := dbConn.pool.Exec(ctx, `UPDATE outbox SET claimed_until = NULL WHERE id = ANY($1) AND sent_at IS NULL`, ids)
+	return err
+}
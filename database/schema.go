@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"hangout.com/core/storage-service/logger"
+)
+
+// schema holds the statements for the tables owned by this service.
+// Every statement must be idempotent as it runs on each start up.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		topic TEXT NOT NULL,
+		message_key TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		headers JSONB NOT NULL DEFAULT '{}'::jsonb,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		claimed_until TIMESTAMPTZ,
+		sent_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL`,
+	// media belongs to the app, this service only adds the progress it reports while processing.
+	// Without media the service can not work at all, so a missing table fails the start up.
+	`ALTER TABLE media ADD COLUMN IF NOT EXISTS progress_percent REAL NOT NULL DEFAULT 0`,
+}
+
+func migrate(ctx context.Context, pool *pgxpool.Pool, log logger.Log) error {
+	for _, statement := range schema {
+		if _, err := pool.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	log.Info(ctx, "database schema is up to date")
+	return nil
+}
@@ -0,0 +1,85 @@
+package exceptions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Stage is a step of processing a single file
+type Stage string
+
+const (
+	StageStatusCheck        Stage = "status-check"
+	StageAdmission          Stage = "admission"
+	StageDownload           Stage = "download"
+	StageProbe              Stage = "probe"
+	StageProcess            Stage = "process"
+	StageTranscodeRendition Stage = "transcode-rendition"
+	StageAudio              Stage = "audio"
+	StagePackage            Stage = "package"
+	StagePreview            Stage = "preview"
+	StageUpload             Stage = "upload"
+	StageStatusUpdate       Stage = "status-update"
+)
+
+// StageError is a failure in one stage of processing a file.
+// For stages that run an external program it carries the exit code and the tail of its stderr.
+type StageError struct {
+	Stage Stage
+	// Detail narrows down where in the stage it failed, for example the rendition
+	Detail string
+	// ExitCode of the external program, -1 when it did not exit on its own or none was run
+	ExitCode int
+	Stderr   string
+	// Permanent failures will fail again however often they are retried
+	Permanent bool
+	Err       error
+}
+
+func (e *StageError) Error() string {
+	var b strings.Builder
+	b.WriteString(string(e.Stage))
+	if e.Detail != "" {
+		b.WriteString(" (" + e.Detail + ")")
+	}
+	b.WriteString(" failed")
+	if e.ExitCode > 0 {
+		fmt.Fprintf(&b, " with exit code %d", e.ExitCode)
+	}
+	if e.Err != nil {
+		b.WriteString(": " + e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// NewStageError wraps err as a failure of stage
+func NewStageError(stage Stage, detail string, err error) *StageError {
+	return &StageError{Stage: stage, Detail: detail, ExitCode: -1, Err: err}
+}
+
+// NewPermanentStageError wraps err as a failure of stage that retrying will not fix
+func NewPermanentStageError(stage Stage, detail string, err error) *StageError {
+	stageErr := NewStageError(stage, detail, err)
+	stageErr.Permanent = true
+	return stageErr
+}
+
+// StageOf returns the stage of the first StageError in the chain of err, or an empty stage if there is none
+func StageOf(err error) Stage {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage
+	}
+	return ""
+}
+
+// IsPermanent reports whether err contains a StageError marked as permanent
+func IsPermanent(err error) bool {
+	var stageErr *StageError
+	return errors.As(err, &stageErr) && stageErr.Permanent
+}
@@ -0,0 +1,24 @@
+package exceptions
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout matches every TimeoutError
+var ErrTimeout = errors.New("timed out")
+
+// TimeoutError is the cancellation cause of a job or a pipeline stage that ran longer than allowed
+type TimeoutError struct {
+	Scope string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Scope, e.Limit)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
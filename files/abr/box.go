@@ -0,0 +1,196 @@
+package abr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMalformedMP4 is returned for files that are not valid ISO BMFF
+var ErrMalformedMP4 = errors.New("malformed mp4")
+
+// box is an ISO BMFF box. Data is the payload after the header, Raw the whole box including the header.
+type box struct {
+	Type string
+	Data []byte
+	Raw  []byte
+}
+
+// readBoxes splits data into consecutive boxes
+func readBoxes(data []byte) ([]box, error) {
+	var boxes []box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated box header", ErrMalformedMP4)
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: truncated large box header of %s", ErrMalformedMP4, boxType)
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: box %s has invalid size %d", ErrMalformedMP4, boxType, size)
+		}
+		boxes = append(boxes, box{Type: boxType, Data: data[header:size], Raw: data[:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// boxHeader is the position of a box in a file. Offset is where the box starts, Size includes the header.
+type boxHeader struct {
+	Type   string
+	Offset int64
+	Header int64
+	Size   int64
+}
+
+// scanBoxes walks the consecutive boxes of a file of the given size and hands every header to visit,
+// without reading the payloads. It follows the same rules as readBoxes.
+func scanBoxes(file io.ReaderAt, size int64, visit func(boxHeader) error) error {
+	var header [16]byte
+	for offset := int64(0); offset < size; {
+		remaining := size - offset
+		if remaining < 8 {
+			return fmt.Errorf("%w: truncated box header", ErrMalformedMP4)
+		}
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+		boxSize := uint64(binary.BigEndian.Uint32(header[:]))
+		b := boxHeader{Type: string(header[4:8]), Offset: offset, Header: 8}
+		switch boxSize {
+		case 0:
+			// the box extends to the end of the file
+			boxSize = uint64(remaining)
+		case 1:
+			if remaining < 16 {
+				return fmt.Errorf("%w: truncated large box header of %s", ErrMalformedMP4, b.Type)
+			}
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return err
+			}
+			boxSize = binary.BigEndian.Uint64(header[8:])
+			b.Header = 16
+		}
+		if boxSize < uint64(b.Header) || boxSize > uint64(remaining) {
+			return fmt.Errorf("%w: box %s has invalid size %d", ErrMalformedMP4, b.Type, boxSize)
+		}
+		b.Size = int64(boxSize)
+		if err := visit(b); err != nil {
+			return err
+		}
+		offset += b.Size
+	}
+	return nil
+}
+
+// readBox reads a box found by scanBoxes into memory
+func readBox(file io.ReaderAt, header boxHeader) (box, error) {
+	raw := make([]byte, header.Size)
+	if _, err := file.ReadAt(raw, header.Offset); err != nil {
+		return box{}, err
+	}
+	return box{Type: header.Type, Data: raw[header.Header:], Raw: raw}, nil
+}
+
+// child returns the first child box of the given type
+func child(parent []byte, boxType string) (box, bool) {
+	boxes, err := readBoxes(parent)
+	if err != nil {
+		return box{}, false
+	}
+	for _, b := range boxes {
+		if b.Type == boxType {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// children returns every child box of the given type
+func children(parent []byte, boxType string) []box {
+	boxes, _ := readBoxes(parent)
+	var matching []box
+	for _, b := range boxes {
+		if b.Type == boxType {
+			matching = append(matching, b)
+		}
+	}
+	return matching
+}
+
+// path walks down the box hierarchy, for example path(moov, "trak", "mdia", "mdhd")
+func path(parent []byte, boxTypes ...string) (box, bool) {
+	var current box
+	data := parent
+	for _, boxType := range boxTypes {
+		var ok bool
+		current, ok = child(data, boxType)
+		if !ok {
+			return box{}, false
+		}
+		data = current.Data
+	}
+	return current, true
+}
+
+// reader reads big endian fields from a box payload and remembers if it ran out of data
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("%w: truncated box", ErrMalformedMP4)
+		r.data = nil
+		return
+	}
+	r.data = r.data[n:]
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.skip(n)
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *reader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+func (r *reader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.bytes(8))
+}
+
+// fullBox reads the version and flags of a full box
+func (r *reader) fullBox() (version uint8, flags uint32) {
+	header := r.u32()
+	return uint8(header >> 24), header & 0xffffff
+}
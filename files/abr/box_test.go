@@ -0,0 +1,203 @@
+package abr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// mkbox writes a box with a 32 bit size
+func mkbox(boxType string, payload ...[]byte) []byte {
+	content := bytes.Join(payload, nil)
+	return append(append(u32(uint32(8+len(content))), boxType...), content...)
+}
+
+// fullBox is the payload of a full box, the version and flags followed by the fields
+func fullBox(version uint8, flags uint32, fields ...[]byte) []byte {
+	return append(u32(uint32(version)<<24|flags), bytes.Join(fields, nil)...)
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// TestReadBoxes checks readBoxes over a payload in memory and scanBoxes over the same bytes as a file
+func TestReadBoxes(t *testing.T) {
+	large := append(append(u32(1), "mdat"...), u64(20)...)
+	large = append(large, 1, 2, 3, 4)
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "consecutive boxes", data: append(mkbox("ftyp", []byte("isom")), mkbox("free")...), want: []string{"ftyp", "free"}},
+		{name: "size 0 extends to the end", data: append(mkbox("moof"), append(append(u32(0), "mdat"...), 1, 2, 3)...), want: []string{"moof", "mdat"}},
+		{name: "size 1 has a 64 bit size", data: append(large, mkbox("free")...), want: []string{"mdat", "free"}},
+		{name: "empty", data: nil},
+		{name: "truncated header", data: []byte{0, 0, 0, 8, 'f'}, wantErr: true},
+		{name: "truncated large header", data: append(u32(1), "mdat"...), wantErr: true},
+		{name: "size smaller than the header", data: append(u32(4), "free"...), wantErr: true},
+		{name: "large size smaller than the header", data: append(append(u32(1), "mdat"...), u64(8)...), wantErr: true},
+		{name: "size beyond the data", data: append(u32(64), "free"...), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			boxes, err := readBoxes(test.data)
+			var types []string
+			for _, b := range boxes {
+				types = append(types, b.Type)
+			}
+			check(t, "readBoxes", types, err, test.want, test.wantErr)
+
+			var scanned []string
+			err = scanBoxes(bytes.NewReader(test.data), int64(len(test.data)), func(header boxHeader) error {
+				scanned = append(scanned, header.Type)
+				return nil
+			})
+			check(t, "scanBoxes", scanned, err, test.want, test.wantErr)
+		})
+	}
+	// the payload of a large box starts after its 16 byte header
+	boxes, err := readBoxes(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(boxes[0].Data, []byte{1, 2, 3, 4}) || len(boxes[0].Raw) != 20 {
+		t.Errorf("got data %v and %d raw bytes", boxes[0].Data, len(boxes[0].Raw))
+	}
+	err = scanBoxes(bytes.NewReader(large), int64(len(large)), func(header boxHeader) error {
+		b, err := readBox(bytes.NewReader(large), header)
+		if err == nil && (!bytes.Equal(b.Data, []byte{1, 2, 3, 4}) || len(b.Raw) != 20) {
+			t.Errorf("got data %v and %d raw bytes", b.Data, len(b.Raw))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func check(t *testing.T, walker string, types []string, err error, want []string, wantErr bool) {
+	t.Helper()
+	if wantErr {
+		if !errors.Is(err, ErrMalformedMP4) {
+			t.Fatalf("%s: got %v, want %v", walker, err, ErrMalformedMP4)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", walker, err)
+	}
+	if len(types) != len(want) {
+		t.Fatalf("%s: got boxes %v, want %v", walker, types, want)
+	}
+	for i := range types {
+		if types[i] != want[i] {
+			t.Fatalf("%s: got boxes %v, want %v", walker, types, want)
+		}
+	}
+}
+
+// Sample flags of the first sample of a fragment
+const (
+	syncFlags    = 0x02000000
+	nonSyncFlags = 0x01010000
+)
+
+// moof writes a movie fragment of a single track run starting at start. The first sample flags of the run
+// tell whether the fragment starts with a sync sample.
+func moof(start uint64, durations []uint32, sync bool) []byte {
+	first := uint32(nonSyncFlags)
+	if sync {
+		first = syncFlags
+	}
+	run := [][]byte{u32(uint32(len(durations))), u32(first)}
+	for _, duration := range durations {
+		run = append(run, u32(duration))
+	}
+	return mkbox("moof",
+		mkbox("mfhd", fullBox(0, 0, u32(1))),
+		mkbox("traf",
+			mkbox("tfhd", fullBox(0, 0x20000, u32(1))),
+			mkbox("tfdt", fullBox(1, 0, u64(start))),
+			mkbox("trun", fullBox(0, 0x4|0x100, run...)),
+		),
+	)
+}
+
+func TestParseMoof(t *testing.T) {
+	track := trackInfo{timescale: 1000, defaultSampleDuration: 40}
+	tests := []struct {
+		name    string
+		moof    []byte
+		want    fragment
+		wantErr bool
+	}{
+		{name: "first sample flags mark a sync sample", moof: moof(2000, []uint32{40, 40, 20}, true), want: fragment{start: 2000, duration: 100, samples: 3, sync: true}},
+		{name: "first sample flags mark a non sync sample", moof: moof(0, []uint32{40}, false), want: fragment{duration: 40, samples: 1}},
+		{
+			name: "default flags of the track fragment",
+			moof: mkbox("moof", mkbox("traf",
+				mkbox("tfhd", fullBox(0, 0x20|0x8, u32(1), u32(20), u32(nonSyncFlags))),
+				mkbox("tfdt", fullBox(0, 0, u32(500))),
+				mkbox("trun", fullBox(0, 0, u32(2))),
+			)),
+			want: fragment{start: 500, duration: 40, samples: 2},
+		},
+		{
+			name: "per sample flags and the default duration of the track",
+			moof: mkbox("moof", mkbox("traf",
+				mkbox("tfhd", fullBox(0, 0, u32(1))),
+				mkbox("trun", fullBox(0, 0x400, u32(2), u32(syncFlags), u32(nonSyncFlags))),
+			)),
+			want: fragment{duration: 80, samples: 2, sync: true},
+		},
+		{
+			name: "without any flags every fragment is a sync point",
+			moof: mkbox("moof", mkbox("traf", mkbox("trun", fullBox(0, 0x100, u32(1), u32(1024))))),
+			want: fragment{duration: 1024, samples: 1, sync: true},
+		},
+		{
+			name: "runs add up",
+			moof: mkbox("moof", mkbox("traf",
+				mkbox("trun", fullBox(0, 0x100|0x4, u32(1), u32(nonSyncFlags), u32(10))),
+				mkbox("trun", fullBox(0, 0x100, u32(2), u32(10), u32(10))),
+			)),
+			want: fragment{duration: 30, samples: 3},
+		},
+		{name: "no track fragment", moof: mkbox("moof", mkbox("mfhd", fullBox(0, 0, u32(1)))), wantErr: true},
+		{name: "truncated run", moof: mkbox("moof", mkbox("traf", mkbox("trun", fullBox(0, 0x100, u32(3), u32(40))))), wantErr: true},
+		{name: "truncated decode time", moof: mkbox("moof", mkbox("traf", mkbox("tfdt", fullBox(1, 0, u32(1))))), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			boxes, err := readBoxes(test.moof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseMoof(boxes[0].Data, track)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.start != test.want.start || got.duration != test.want.duration || got.samples != test.want.samples || got.sync != test.want.sync {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package abr
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// codecString builds the RFC 6381 codecs parameter of a sample entry, for example avc1.64001F or mp4a.40.2.
+// It falls back to the sample entry type for codecs it does not know the configuration record of.
+func codecString(entry box) string {
+	// sample entries start with 6 reserved bytes and the data reference index
+	const sampleEntryHeader = 8
+	// visual sample entries have 70 bytes of fields before their child boxes, audio sample entries 20
+	var configs []byte
+	switch entry.Type {
+	case "avc1", "avc3", "hvc1", "hev1", "vp09", "av01":
+		if len(entry.Data) > sampleEntryHeader+70 {
+			configs = entry.Data[sampleEntryHeader+70:]
+		}
+	case "mp4a", "Opus":
+		if len(entry.Data) > sampleEntryHeader+20 {
+			configs = entry.Data[sampleEntryHeader+20:]
+		}
+	}
+	switch entry.Type {
+	case "avc1", "avc3":
+		if avcC, ok := child(configs, "avcC"); ok && len(avcC.Data) >= 4 {
+			return fmt.Sprintf("%s.%02X%02X%02X", entry.Type, avcC.Data[1], avcC.Data[2], avcC.Data[3])
+		}
+	case "hvc1", "hev1":
+		if hvcC, ok := child(configs, "hvcC"); ok && len(hvcC.Data) >= 13 {
+			return hevcCodecString(entry.Type, hvcC.Data)
+		}
+	case "vp09":
+		if vpcC, ok := child(configs, "vpcC"); ok && len(vpcC.Data) >= 7 {
+			// full box header, profile, level, then the bit depth in the upper 4 bits
+			return fmt.Sprintf("vp09.%02d.%02d.%02d", vpcC.Data[4], vpcC.Data[5], vpcC.Data[6]>>4)
+		}
+	case "av01":
+		if av1C, ok := child(configs, "av1C"); ok && len(av1C.Data) >= 3 {
+			return av1CodecString(av1C.Data)
+		}
+	case "mp4a":
+		if esds, ok := child(configs, "esds"); ok {
+			if codec := aacCodecString(esds.Data); codec != "" {
+				return codec
+			}
+		}
+		return "mp4a.40.2"
+	case "Opus":
+		return "opus"
+	}
+	return entry.Type
+}
+
+// hevcCodecString follows ISO/IEC 14496-15 annex E
+func hevcCodecString(entryType string, hvcC []byte) string {
+	profileSpace := hvcC[1] >> 6
+	tier := "L"
+	if hvcC[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profile := hvcC[1] & 0x1f
+	compatibility := bits.Reverse32(uint32(hvcC[2])<<24 | uint32(hvcC[3])<<16 | uint32(hvcC[4])<<8 | uint32(hvcC[5]))
+	level := hvcC[12]
+	var b strings.Builder
+	b.WriteString(entryType + ".")
+	if profileSpace > 0 {
+		b.WriteByte("ABC"[profileSpace-1])
+	}
+	fmt.Fprintf(&b, "%d.%X.%s%d", profile, compatibility, tier, level)
+	// constraint flags, trailing zero bytes are left out
+	constraints := hvcC[6:12]
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+	for _, constraint := range constraints[:last] {
+		fmt.Fprintf(&b, ".%X", constraint)
+	}
+	return b.String()
+}
+
+// av1CodecString follows the AV1 codec ISO media file format binding
+func av1CodecString(av1C []byte) string {
+	profile := av1C[1] >> 5
+	level := av1C[1] & 0x1f
+	tier := "M"
+	if av1C[2]&0x80 != 0 {
+		tier = "H"
+	}
+	bitDepth := 8
+	if av1C[2]&0x40 != 0 {
+		bitDepth = 10
+		if profile == 2 && av1C[2]&0x20 != 0 {
+			bitDepth = 12
+		}
+	}
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", profile, level, tier, bitDepth)
+}
+
+// aacCodecString reads the object type and the audio object type from an elementary stream descriptor
+func aacCodecString(esds []byte) string {
+	r := &reader{data: esds}
+	r.fullBox()
+	for r.err == nil && len(r.data) > 0 {
+		tag := r.u8()
+		size := descriptorSize(r)
+		switch tag {
+		case 0x03:
+			// ES descriptor: id, flags and the optional fields they announce
+			r.u16()
+			flags := r.u8()
+			if flags&0x80 != 0 {
+				r.u16()
+			}
+			if flags&0x40 != 0 {
+				r.skip(int(r.u8()))
+			}
+			if flags&0x20 != 0 {
+				r.u16()
+			}
+		case 0x04:
+			objectType := r.u8()
+			r.skip(12)
+			if r.err != nil {
+				return ""
+			}
+			if len(r.data) > 0 && r.u8() == 0x05 {
+				descriptorSize(r)
+				audioObjectType := r.u8() >> 3
+				if r.err == nil {
+					return fmt.Sprintf("mp4a.%02x.%d", objectType, audioObjectType)
+				}
+			}
+			return fmt.Sprintf("mp4a.%02x", objectType)
+		default:
+			r.skip(size)
+		}
+	}
+	return ""
+}
+
+// descriptorSize reads the variable length size of an MPEG-4 descriptor
+func descriptorSize(r *reader) int {
+	size := 0
+	for i := 0; i < 4; i++ {
+		b := r.u8()
+		size = size<<7 | int(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return size
+}
@@ -2,36 +2,108 @@ package abr
 
 import (
 	"context"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"slices"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"hangout.com/core/storage-service/exceptions"
 	"hangout.com/core/storage-service/logger"
 )
 
-func CreatePlaylist(ctx context.Context, outputFilePath string, encoding string, log logger.Log) error {
+// Manifest formats the playlist can be written in
+const (
+	DASH = "dash"
+	HLS  = "hls"
+)
+
+// Extension returns the file extension of the main playlist of a format
+func Extension(format string) string {
+	if format == HLS {
+		return ".m3u8"
+	}
+	return ".mpd"
+}
+
+// Track is an encoded video rendition or audio track that goes into a manifest.
+// The file has to be a fragmented MP4 with a single track.
+type Track struct {
+	// File is the path of the encoded track
+	File  string
+	Id    string
+	Audio bool
+	// AudioId is the id of the audio track that plays along with a video track, empty if there is none
+	AudioId string
+}
+
+// CreatePlaylist segments the tracks into fragmented MP4 segments and writes a playlist in every requested
+// format next to them, named manifestBase plus the extension of the format. DASH and HLS share the same segments,
+// for HLS a media playlist per track is written besides the master playlist. Tracks of different codecs end up
+// in separate adaptation sets, in the order they are given.
+func CreatePlaylist(ctx context.Context, manifestBase string, tracks []Track, formats []string, log logger.Log) error {
 	tr := otel.Tracer("hangout.storage.files")
 	ctx, span := tr.Start(ctx, "CreatePlaylist")
 	defer span.End()
 	span.SetAttributes(
-		attribute.String("outputFilePath", outputFilePath),
-		attribute.String("video-encoding", encoding),
+		attribute.String("manifest", manifestBase),
+		attribute.Int("tracks", len(tracks)),
+		attribute.StringSlice("formats", formats),
 	)
 	log.Info(ctx, "pipeline status status", "segementation and playlist creation", "starting")
-	videoFile := outputFilePath + "_" + encoding + "_"
-	audioFile := outputFilePath + "_" + encoding + "_audio.mp4"
-	var cmd *exec.Cmd
-	var err error
-	log.Debug(ctx, "Input", "video file path", videoFile)
-	log.Debug(ctx, "Input", "audio file path", audioFile)
-	log.Debug(ctx, "Input", "output file path", outputFilePath)
-	cmd = exec.Command("MP4Box", "-dash", "2000", "-frag", "2000", "-segment-name", "segment_$RepresentationID$_", "-fps", "30", videoFile+"640p.mp4#video:id=640p", videoFile+"1280p.mp4#video:id=1280p", videoFile+"1920p.mp4#video:id=1920p", audioFile+"#audio:id=English:role=main", "-out", outputFilePath+".mpd")
-	_, err = cmd.Output()
-	if err != nil {
-		log.Error(ctx, "error in processing segmentation and playlist creation", "error", err.Error())
-		return err
-	} else {
-		log.Info(ctx, "pipeline status status", "segementation and playlist creation", "finished")
+	log.Debug(ctx, "Input", "manifest path", manifestBase, "formats", formats)
+	outputDir := filepath.Dir(manifestBase)
+	var representations []*Representation
+	for _, track := range tracks {
+		log.Debug(ctx, "Input", "track", track.File, "id", track.Id)
+		representation, err := SegmentTrack(track, outputDir)
+		if err != nil {
+			return packageError(ctx, track.Id, err, log)
+		}
+		span.AddEvent("track.segmented", traceAttributes(representation))
+		representations = append(representations, representation)
 	}
+	if slices.Contains(formats, DASH) {
+		manifest, err := BuildMPD(representations)
+		if err == nil {
+			err = os.WriteFile(manifestBase+Extension(DASH), manifest, 0644)
+		}
+		if err != nil {
+			return packageError(ctx, DASH, err, log)
+		}
+	}
+	if slices.Contains(formats, HLS) {
+		for _, representation := range representations {
+			err := os.WriteFile(filepath.Join(outputDir, MediaPlaylist(representation)), BuildMediaPlaylist(representation), 0644)
+			if err != nil {
+				return packageError(ctx, HLS, err, log)
+			}
+		}
+		if err := os.WriteFile(manifestBase+Extension(HLS), BuildMasterPlaylist(representations), 0644); err != nil {
+			return packageError(ctx, HLS, err, log)
+		}
+	}
+	log.Info(ctx, "pipeline status status", "segementation and playlist creation", "finished")
 	return nil
 }
+
+func packageError(ctx context.Context, detail string, err error, log logger.Log) error {
+	err = exceptions.NewStageError(exceptions.StagePackage, detail, err)
+	log.Error(ctx, "error in processing segmentation and playlist creation", "error", err.Error())
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+func traceAttributes(r *Representation) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("representation.id", r.Id),
+		attribute.String("representation.codecs", r.Codecs),
+		attribute.Int("representation.bandwidth", r.Bandwidth),
+		attribute.Int("representation.segments", len(r.Segments)),
+		attribute.Float64("representation.duration", r.Duration()),
+	)
+}
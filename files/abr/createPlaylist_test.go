@@ -0,0 +1,63 @@
+package abr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/command/commandtest"
+	"hangout.com/core/storage-service/logger"
+)
+
+// TestCreatePlaylistFromClip packages a synthetic clip encoded the way the pipeline encodes renditions and audio tracks
+func TestCreatePlaylistFromClip(t *testing.T) {
+	clip := commandtest.Clip(t, 320, 240, 6)
+	dir := t.TempDir()
+	video, audio := filepath.Join(dir, "clip_h264_240p.mp4"), filepath.Join(dir, "clip_audio_aac.mp4")
+	for _, args := range [][]string{
+		{"-y", "-i", clip, "-an", "-c:v", "libx264", "-preset", "ultrafast", "-g", "50", "-keyint_min", "50", "-sc_threshold", "0",
+			"-movflags", "+frag_keyframe+empty_moov+default_base_moof", video},
+		{"-y", "-i", clip, "-vn", "-c:a", "aac", "-movflags", "+empty_moov+default_base_moof", "-frag_duration", "2000000", audio},
+	} {
+		if _, err := (command.Exec{}).Run(context.Background(), command.Cmd{Name: "ffmpeg", Args: args, Stage: exceptions.StageTranscodeRendition}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracks := []Track{
+		{File: video, Id: "h264_240p", AudioId: "audio_aac"},
+		{File: audio, Id: "audio_aac", Audio: true},
+	}
+	cfg := koanf.New(".")
+	cfg.Set("log.level", "error")
+	if err := CreatePlaylist(context.Background(), filepath.Join(dir, "clip"), tracks, []string{DASH, HLS}, logger.NewLogger(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	mpd, err := os.ReadFile(filepath.Join(dir, "clip.mpd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`codecs="avc1.`, `codecs="mp4a.40.2"`, `width="320"`, `height="240"`} {
+		if !strings.Contains(string(mpd), want) {
+			t.Errorf("manifest lacks %s:\n%s", want, mpd)
+		}
+	}
+	master, err := os.ReadFile(filepath.Join(dir, "clip.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(master), `AUDIO="audio_aac"`) || !strings.Contains(string(master), "RESOLUTION=320x240") {
+		t.Errorf("unexpected master playlist:\n%s", master)
+	}
+	// a keyframe every 2 seconds gives a segment per keyframe interval
+	for segment := 1; segment <= 3; segment++ {
+		if _, err := os.Stat(filepath.Join(dir, "segment_h264_240p_"+strconv.Itoa(segment)+".m4s")); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package abr
+
+import (
+	"fmt"
+	"io"
+)
+
+// trackInfo is what the initialization segment tells about the single track of a fragmented MP4
+type trackInfo struct {
+	id        uint32
+	timescale uint32
+	handler   string
+	codecs    string
+	width     int
+	height    int
+	// sampleRate and channels are only set for audio
+	sampleRate int
+	channels   int
+	// defaultSampleDuration from the track extends box, used when fragments do not carry durations
+	defaultSampleDuration uint32
+}
+
+// fragment is a movie fragment and its media data, which stay in the file and are only referred to by position
+type fragment struct {
+	boxes    []boxHeader
+	start    uint64
+	duration uint64
+	samples  int
+	size     int64
+	// sync reports whether the fragment starts with a sync sample, segments may only start at one
+	sync bool
+}
+
+// fragmentedMP4 is a parsed single track fragmented MP4 as written by ffmpeg with frag_keyframe or frag_duration
+type fragmentedMP4 struct {
+	init      []byte
+	track     trackInfo
+	fragments []fragment
+}
+
+// readFragmentedMP4 reads the initialization segment and the movie fragments of a file. Media data is
+// not read, so memory does not grow with the length of the rendition.
+func readFragmentedMP4(file io.ReaderAt, size int64) (*fragmentedMP4, error) {
+	parsed := &fragmentedMP4{}
+	var current *fragment
+	err := scanBoxes(file, size, func(header boxHeader) error {
+		switch header.Type {
+		case "ftyp", "moov", "moof":
+			b, err := readBox(file, header)
+			if err != nil {
+				return err
+			}
+			switch header.Type {
+			case "ftyp":
+				parsed.init = append(parsed.init, b.Raw...)
+			case "moov":
+				parsed.init = append(parsed.init, b.Raw...)
+				if parsed.track, err = parseMoov(b.Data); err != nil {
+					return err
+				}
+			case "moof":
+				if parsed.track.timescale == 0 {
+					return fmt.Errorf("%w: movie fragment before the movie box", ErrMalformedMP4)
+				}
+				f, err := parseMoof(b.Data, parsed.track)
+				if err != nil {
+					return err
+				}
+				f.boxes = []boxHeader{header}
+				f.size = header.Size
+				parsed.fragments = append(parsed.fragments, f)
+				current = &parsed.fragments[len(parsed.fragments)-1]
+			}
+		case "mdat":
+			if current == nil {
+				return fmt.Errorf("%w: media data outside of a fragment, the file is not fragmented", ErrMalformedMP4)
+			}
+			current.boxes = append(current.boxes, header)
+			current.size += header.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parsed.track.timescale == 0 {
+		return nil, fmt.Errorf("%w: no movie box", ErrMalformedMP4)
+	}
+	if len(parsed.fragments) == 0 {
+		return nil, fmt.Errorf("%w: no movie fragments, the file is not fragmented", ErrMalformedMP4)
+	}
+	return parsed, nil
+}
+
+func parseMoov(moov []byte) (trackInfo, error) {
+	var track trackInfo
+	trak, ok := child(moov, "trak")
+	if !ok {
+		return track, fmt.Errorf("%w: no track", ErrMalformedMP4)
+	}
+	if tkhd, ok := child(trak.Data, "tkhd"); ok {
+		r := &reader{data: tkhd.Data}
+		version, _ := r.fullBox()
+		if version == 1 {
+			r.skip(16)
+		} else {
+			r.skip(8)
+		}
+		track.id = r.u32()
+	}
+	mdhd, ok := path(trak.Data, "mdia", "mdhd")
+	if !ok {
+		return track, fmt.Errorf("%w: no media header", ErrMalformedMP4)
+	}
+	r := &reader{data: mdhd.Data}
+	if version, _ := r.fullBox(); version == 1 {
+		r.skip(16)
+	} else {
+		r.skip(8)
+	}
+	track.timescale = r.u32()
+	if r.err != nil || track.timescale == 0 {
+		return track, fmt.Errorf("%w: invalid media timescale", ErrMalformedMP4)
+	}
+	if hdlr, ok := path(trak.Data, "mdia", "hdlr"); ok && len(hdlr.Data) >= 12 {
+		track.handler = string(hdlr.Data[8:12])
+	}
+	stsd, ok := path(trak.Data, "mdia", "minf", "stbl", "stsd")
+	if !ok || len(stsd.Data) < 8 {
+		return track, fmt.Errorf("%w: no sample description", ErrMalformedMP4)
+	}
+	entries, err := readBoxes(stsd.Data[8:])
+	if err != nil || len(entries) == 0 {
+		return track, fmt.Errorf("%w: no sample entry", ErrMalformedMP4)
+	}
+	entry := entries[0]
+	track.codecs = codecString(entry)
+	switch track.handler {
+	case "vide":
+		if len(entry.Data) >= 28 {
+			r := &reader{data: entry.Data[24:]}
+			track.width, track.height = int(r.u16()), int(r.u16())
+		}
+	case "soun":
+		if len(entry.Data) >= 28 {
+			r := &reader{data: entry.Data[16:]}
+			track.channels = int(r.u16())
+			r.skip(6)
+			track.sampleRate = int(r.u32() >> 16)
+		}
+	}
+	for _, trex := range children(moovExtends(moov), "trex") {
+		r := &reader{data: trex.Data}
+		r.fullBox()
+		if r.u32() == track.id || track.id == 0 {
+			r.skip(4)
+			track.defaultSampleDuration = r.u32()
+		}
+	}
+	return track, nil
+}
+
+func moovExtends(moov []byte) []byte {
+	mvex, _ := child(moov, "mvex")
+	return mvex.Data
+}
+
+const sampleIsNonSync = 0x10000
+
+func parseMoof(moof []byte, track trackInfo) (fragment, error) {
+	f := fragment{sync: true}
+	traf, ok := child(moof, "traf")
+	if !ok {
+		return f, fmt.Errorf("%w: movie fragment without track fragment", ErrMalformedMP4)
+	}
+	defaultDuration := track.defaultSampleDuration
+	var defaultFlags uint32
+	hasDefaultFlags := false
+	if tfhd, ok := child(traf.Data, "tfhd"); ok {
+		r := &reader{data: tfhd.Data}
+		_, flags := r.fullBox()
+		r.u32()
+		if flags&0x1 != 0 {
+			r.u64()
+		}
+		if flags&0x2 != 0 {
+			r.u32()
+		}
+		if flags&0x8 != 0 {
+			defaultDuration = r.u32()
+		}
+		if flags&0x10 != 0 {
+			r.u32()
+		}
+		if flags&0x20 != 0 {
+			defaultFlags = r.u32()
+			hasDefaultFlags = true
+		}
+		if r.err != nil {
+			return f, r.err
+		}
+	}
+	if tfdt, ok := child(traf.Data, "tfdt"); ok {
+		r := &reader{data: tfdt.Data}
+		if version, _ := r.fullBox(); version == 1 {
+			f.start = r.u64()
+		} else {
+			f.start = uint64(r.u32())
+		}
+		if r.err != nil {
+			return f, r.err
+		}
+	}
+	first := true
+	for _, trun := range children(traf.Data, "trun") {
+		r := &reader{data: trun.Data}
+		_, flags := r.fullBox()
+		count := int(r.u32())
+		if flags&0x1 != 0 {
+			r.u32()
+		}
+		firstFlags, hasFirstFlags := uint32(0), false
+		if flags&0x4 != 0 {
+			firstFlags, hasFirstFlags = r.u32(), true
+		}
+		for i := 0; i < count && r.err == nil; i++ {
+			duration := defaultDuration
+			if flags&0x100 != 0 {
+				duration = r.u32()
+			}
+			if flags&0x200 != 0 {
+				r.u32()
+			}
+			sampleFlags, hasSampleFlags := defaultFlags, hasDefaultFlags
+			if flags&0x400 != 0 {
+				sampleFlags, hasSampleFlags = r.u32(), true
+			}
+			if flags&0x800 != 0 {
+				r.u32()
+			}
+			if first {
+				if hasFirstFlags {
+					sampleFlags, hasSampleFlags = firstFlags, true
+				}
+				f.sync = !hasSampleFlags || sampleFlags&sampleIsNonSync == 0
+				first = false
+			}
+			f.duration += uint64(duration)
+		}
+		if r.err != nil {
+			return f, r.err
+		}
+		f.samples += count
+	}
+	return f, nil
+}
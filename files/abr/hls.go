@@ -0,0 +1,81 @@
+package abr
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// MediaPlaylist is the name of the HLS media playlist of a representation
+func MediaPlaylist(r *Representation) string {
+	return "playlist_" + r.Id + ".m3u8"
+}
+
+// BuildMasterPlaylist writes the HLS master playlist. Every audio representation becomes a rendition
+// of its own audio group, video variants refer to the group of the audio they are paired with.
+// Without any video the audio representations are the variants themselves.
+func BuildMasterPlaylist(representations []*Representation) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if !slices.ContainsFunc(representations, func(r *Representation) bool { return !r.Audio }) {
+		for _, r := range representations {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=%q\n%s\n", r.Bandwidth, r.AverageBandwidth, r.Codecs, MediaPlaylist(r))
+		}
+		return []byte(b.String())
+	}
+	audios := map[string]*Representation{}
+	for _, r := range representations {
+		if !r.Audio {
+			continue
+		}
+		audios[r.Id] = r
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=%q,NAME=%q,DEFAULT=YES,AUTOSELECT=YES", r.Id, "main")
+		if r.Channels > 0 {
+			fmt.Fprintf(&b, ",CHANNELS=\"%d\"", r.Channels)
+		}
+		fmt.Fprintf(&b, ",URI=%q\n", MediaPlaylist(r))
+	}
+	for _, r := range representations {
+		if r.Audio {
+			continue
+		}
+		peak, average, codecs := r.Bandwidth, r.AverageBandwidth, r.Codecs
+		audio, paired := audios[r.AudioId]
+		if paired {
+			peak += audio.Bandwidth
+			average += audio.AverageBandwidth
+			codecs += "," + audio.Codecs
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=%q", peak, average, codecs)
+		if r.Width > 0 && r.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", r.Width, r.Height)
+		}
+		if r.FrameRate > 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", r.FrameRate)
+		}
+		if paired {
+			fmt.Fprintf(&b, ",AUDIO=%q", audio.Id)
+		}
+		fmt.Fprintf(&b, "\n%s\n", MediaPlaylist(r))
+	}
+	return []byte(b.String())
+}
+
+// BuildMediaPlaylist writes the VOD media playlist of a representation over its fragmented MP4 segments
+func BuildMediaPlaylist(r *Representation) []byte {
+	var b strings.Builder
+	target := 0.0
+	for _, segment := range r.Segments {
+		target = math.Max(target, float64(segment.Duration)/float64(r.Timescale))
+	}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:1\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", r.InitSegment)
+	for _, segment := range r.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", float64(segment.Duration)/float64(r.Timescale), segment.File)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,179 @@
+package abr
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func video(id string, codecs string, width int, height int, audioId string, segments ...Segment) *Representation {
+	return &Representation{
+		Id: id, Codecs: codecs, Width: width, Height: height, FrameRate: 25, AudioId: audioId,
+		Timescale: 1000, Bandwidth: 1000000, AverageBandwidth: 800000, InitSegment: "segment_" + id + "_init.mp4", Segments: segments,
+	}
+}
+
+func audio(id string, codecs string) *Representation {
+	return &Representation{
+		Id: id, Audio: true, Codecs: codecs, SampleRate: 48000, Channels: 2,
+		Timescale: 48000, Bandwidth: 130000, AverageBandwidth: 128000, InitSegment: "segment_" + id + "_init.mp4",
+		Segments: []Segment{{File: "segment_" + id + "_1.m4s", Start: 0, Duration: 96000}},
+	}
+}
+
+func TestBuildMPDTimeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []Segment
+		want     []timelineEntry
+	}{
+		{
+			name:     "equal segments collapse into a repeat",
+			segments: []Segment{{Start: 0, Duration: 2000}, {Start: 2000, Duration: 2000}, {Start: 4000, Duration: 2000}, {Start: 6000, Duration: 1000}},
+			want:     []timelineEntry{{T: ptr(0), D: 2000, R: 2}, {T: ptr(6000), D: 1000}},
+		},
+		{
+			name:     "a gap starts a new entry",
+			segments: []Segment{{Start: 0, Duration: 2000}, {Start: 2000, Duration: 2000}, {Start: 4500, Duration: 2000}},
+			want:     []timelineEntry{{T: ptr(0), D: 2000, R: 1}, {T: ptr(4500), D: 2000}},
+		},
+		{
+			name:     "a segment of another length breaks the repeat",
+			segments: []Segment{{Start: 0, Duration: 2000}, {Start: 2000, Duration: 3000}, {Start: 5000, Duration: 2000}, {Start: 7000, Duration: 2000}},
+			want:     []timelineEntry{{T: ptr(0), D: 2000}, {T: ptr(2000), D: 3000}, {T: ptr(5000), D: 2000, R: 1}},
+		},
+		{
+			name:     "a timeline that does not start at zero",
+			segments: []Segment{{Start: 1024, Duration: 2000}},
+			want:     []timelineEntry{{T: ptr(1024), D: 2000}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := parseMPD(t, video("h264_720p", "avc1.64001F", 1280, 720, "", test.segments...))
+			got := manifest.Period.AdaptationSets[0].Representations[0].SegmentTemplate.SegmentTimeline.S
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d entries, want %d: %s", len(got), len(test.want), formatTimeline(got))
+			}
+			for i := range got {
+				if *got[i].T != *test.want[i].T || got[i].D != test.want[i].D || got[i].R != test.want[i].R {
+					t.Fatalf("got %s, want %s", formatTimeline(got), formatTimeline(test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestBuildMPDAdaptationSets(t *testing.T) {
+	segments := []Segment{{Start: 0, Duration: 2000}}
+	manifest := parseMPD(t,
+		video("h264_720p", "avc1.64001F", 1280, 720, "audio_aac", segments...),
+		video("h264_360p", "avc1.64001E", 640, 360, "audio_aac", segments...),
+		audio("audio_aac", "mp4a.40.2"),
+		video("hevc_1080p", "hvc1.1.6.L120.90", 1920, 1080, "audio_aac", segments...),
+	)
+	sets := manifest.Period.AdaptationSets
+	if len(sets) != 3 {
+		t.Fatalf("got %d adaptation sets, want one for h264, aac and hevc", len(sets))
+	}
+	if sets[0].ContentType != "video" || len(sets[0].Representations) != 2 || sets[0].MaxWidth != 1280 || sets[0].MaxHeight != 720 {
+		t.Errorf("unexpected h264 set %+v", sets[0])
+	}
+	if sets[1].ContentType != "audio" || sets[1].Role == nil || sets[1].Representations[0].AudioSamplingRate != 48000 {
+		t.Errorf("unexpected audio set %+v", sets[1])
+	}
+	if sets[2].Representations[0].Id != "hevc_1080p" || sets[2].Representations[0].FrameRate != "25" {
+		t.Errorf("unexpected hevc set %+v", sets[2])
+	}
+	if manifest.MediaPresentationDuration != "PT2.000S" {
+		t.Errorf("got duration %s", manifest.MediaPresentationDuration)
+	}
+}
+
+func TestBuildMasterPlaylist(t *testing.T) {
+	segments := []Segment{{Start: 0, Duration: 2000}}
+	got := string(BuildMasterPlaylist([]*Representation{
+		video("h264_720p", "avc1.64001F", 1280, 720, "audio_aac", segments...),
+		audio("audio_aac", "mp4a.40.2"),
+		video("vp9_720p", "vp09.00.31.08", 1280, 720, "audio_opus", segments...),
+		audio("audio_opus", "opus"),
+		video("h264_silent", "avc1.64001E", 640, 360, "", segments...),
+	}))
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio_aac",NAME="main",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="playlist_audio_aac.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio_opus",NAME="main",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="playlist_audio_opus.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1130000,AVERAGE-BANDWIDTH=928000,CODECS="avc1.64001F,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=25.000,AUDIO="audio_aac"
+playlist_h264_720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1130000,AVERAGE-BANDWIDTH=928000,CODECS="vp09.00.31.08,opus",RESOLUTION=1280x720,FRAME-RATE=25.000,AUDIO="audio_opus"
+playlist_vp9_720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AVERAGE-BANDWIDTH=800000,CODECS="avc1.64001E",RESOLUTION=640x360,FRAME-RATE=25.000
+playlist_h264_silent.m3u8
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildMasterPlaylistAudioOnly(t *testing.T) {
+	got := string(BuildMasterPlaylist([]*Representation{audio("audio_aac", "mp4a.40.2"), audio("audio_opus", "opus")}))
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-STREAM-INF:BANDWIDTH=130000,AVERAGE-BANDWIDTH=128000,CODECS="mp4a.40.2"
+playlist_audio_aac.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=130000,AVERAGE-BANDWIDTH=128000,CODECS="opus"
+playlist_audio_opus.m3u8
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildMediaPlaylist(t *testing.T) {
+	got := string(BuildMediaPlaylist(video("h264_720p", "avc1.64001F", 1280, 720, "",
+		Segment{File: "segment_h264_720p_1.m4s", Start: 0, Duration: 2000},
+		Segment{File: "segment_h264_720p_2.m4s", Start: 2000, Duration: 2400},
+		Segment{File: "segment_h264_720p_3.m4s", Start: 4400, Duration: 600},
+	)))
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:3
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="segment_h264_720p_init.mp4"
+#EXTINF:2.000,
+segment_h264_720p_1.m4s
+#EXTINF:2.400,
+segment_h264_720p_2.m4s
+#EXTINF:0.600,
+segment_h264_720p_3.m4s
+#EXT-X-ENDLIST
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func parseMPD(t *testing.T, representations ...*Representation) mpd {
+	t.Helper()
+	out, err := BuildMPD(representations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest mpd
+	if err := xml.Unmarshal(out, &manifest); err != nil {
+		t.Fatalf("could not read the manifest back: %v\n%s", err, out)
+	}
+	return manifest
+}
+
+func ptr(v uint64) *uint64 {
+	return &v
+}
+
+func formatTimeline(entries []timelineEntry) string {
+	out, _ := xml.Marshal(segmentTimeline{S: entries})
+	return string(out)
+}
@@ -0,0 +1,189 @@
+package abr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type mpd struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    period   `xml:"Period"`
+}
+
+type period struct {
+	Id             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	Id               int              `xml:"id,attr"`
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	MaxWidth         int              `xml:"maxWidth,attr,omitempty"`
+	MaxHeight        int              `xml:"maxHeight,attr,omitempty"`
+	Role             *descriptor      `xml:"Role"`
+	Representations  []representation `xml:"Representation"`
+}
+
+type descriptor struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type representation struct {
+	Id                        string          `xml:"id,attr"`
+	Bandwidth                 int             `xml:"bandwidth,attr"`
+	Codecs                    string          `xml:"codecs,attr"`
+	Width                     int             `xml:"width,attr,omitempty"`
+	Height                    int             `xml:"height,attr,omitempty"`
+	FrameRate                 string          `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate         int             `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannelConfiguration *descriptor     `xml:"AudioChannelConfiguration"`
+	SegmentTemplate           segmentTemplate `xml:"SegmentTemplate"`
+}
+
+type segmentTemplate struct {
+	Timescale       uint32          `xml:"timescale,attr"`
+	Initialization  string          `xml:"initialization,attr"`
+	Media           string          `xml:"media,attr"`
+	StartNumber     int             `xml:"startNumber,attr"`
+	SegmentTimeline segmentTimeline `xml:"SegmentTimeline"`
+}
+
+type segmentTimeline struct {
+	S []timelineEntry `xml:"S"`
+}
+
+type timelineEntry struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// BuildMPD writes a static DASH manifest of the live profile with a SegmentTimeline per representation.
+// Representations of the same kind and codec share an adaptation set, the sets keep the order of the representations.
+func BuildMPD(representations []*Representation) ([]byte, error) {
+	manifest := mpd{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: isoDuration(SegmentDuration),
+		Period:        period{Id: "0", Start: isoDuration(0)},
+	}
+	var duration float64
+	sets := map[string]int{}
+	for _, r := range representations {
+		duration = math.Max(duration, r.Duration())
+		key := contentType(r) + "/" + codecFamily(r.Codecs)
+		index, ok := sets[key]
+		if !ok {
+			index = len(manifest.Period.AdaptationSets)
+			sets[key] = index
+			set := adaptationSet{
+				Id:               index,
+				ContentType:      contentType(r),
+				MimeType:         contentType(r) + "/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+			}
+			if r.Audio {
+				set.Role = &descriptor{SchemeIdUri: "urn:mpeg:dash:role:2011", Value: "main"}
+			}
+			manifest.Period.AdaptationSets = append(manifest.Period.AdaptationSets, set)
+		}
+		set := &manifest.Period.AdaptationSets[index]
+		set.MaxWidth = max(set.MaxWidth, r.Width)
+		set.MaxHeight = max(set.MaxHeight, r.Height)
+		set.Representations = append(set.Representations, toMPDRepresentation(r))
+	}
+	manifest.MediaPresentationDuration = isoDuration(duration)
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+func toMPDRepresentation(r *Representation) representation {
+	rep := representation{
+		Id:        r.Id,
+		Bandwidth: r.Bandwidth,
+		Codecs:    r.Codecs,
+		Width:     r.Width,
+		Height:    r.Height,
+		SegmentTemplate: segmentTemplate{
+			Timescale:      r.Timescale,
+			Initialization: r.InitSegment,
+			Media:          r.MediaTemplate(),
+			StartNumber:    1,
+		},
+	}
+	if r.Audio {
+		rep.AudioSamplingRate = r.SampleRate
+		if r.Channels > 0 {
+			rep.AudioChannelConfiguration = &descriptor{
+				SchemeIdUri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+				Value:       strconv.Itoa(r.Channels),
+			}
+		}
+	} else {
+		rep.FrameRate = frameRate(r.FrameRate)
+	}
+	// consecutive segments of the same duration collapse into one entry with a repeat count
+	timeline := &rep.SegmentTemplate.SegmentTimeline
+	var next uint64
+	for i, segment := range r.Segments {
+		last := len(timeline.S) - 1
+		if i > 0 && segment.Start == next && timeline.S[last].D == segment.Duration {
+			timeline.S[last].R++
+		} else {
+			start := segment.Start
+			timeline.S = append(timeline.S, timelineEntry{T: &start, D: segment.Duration})
+		}
+		next = segment.Start + segment.Duration
+	}
+	return rep
+}
+
+func contentType(r *Representation) string {
+	if r.Audio {
+		return "audio"
+	}
+	return "video"
+}
+
+// codecFamily is the part of a codecs string before the first dot, for example avc1 for avc1.64001F
+func codecFamily(codecs string) string {
+	family, _, _ := strings.Cut(codecs, ".")
+	return family
+}
+
+// frameRate formats a frame rate for the manifest, NTSC rates as a fraction over 1001
+func frameRate(fps float64) string {
+	if fps <= 0 {
+		return ""
+	}
+	if rounded := math.Round(fps); math.Abs(fps-rounded) < 0.01 {
+		return strconv.Itoa(int(rounded))
+	}
+	if ntsc := math.Round(fps * 1.001); math.Abs(fps-ntsc/1.001) < 0.01 {
+		return strconv.Itoa(int(ntsc*1000)) + "/1001"
+	}
+	return strconv.FormatFloat(fps, 'f', 3, 64)
+}
+
+// isoDuration formats seconds as an ISO 8601 duration
+func isoDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
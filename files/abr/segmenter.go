@@ -0,0 +1,185 @@
+package abr
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SegmentDuration is the target length of a segment in seconds. Segments only start at sync samples,
+// so they are as long as the keyframe interval of the encoder if that is longer.
+const SegmentDuration = 2.0
+
+// Segment is a single media segment of a representation. Start and Duration are in the timescale of the representation.
+type Segment struct {
+	File     string
+	Start    uint64
+	Duration uint64
+	Size     int
+}
+
+// Representation is a segmented track together with the properties manifests need to describe it
+type Representation struct {
+	Id    string
+	Audio bool
+	// AudioId is the audio representation that plays along with a video representation
+	AudioId string
+	Codecs  string
+	Width   int
+	Height  int
+	// FrameRate is the average frame rate of a video representation
+	FrameRate  float64
+	SampleRate int
+	Channels   int
+	Timescale  uint32
+	// Bandwidth is the peak bitrate over all segments in bits per second, AverageBandwidth the mean
+	Bandwidth        int
+	AverageBandwidth int
+	InitSegment      string
+	Segments         []Segment
+}
+
+// Duration returns the length of the representation in seconds
+func (r *Representation) Duration() float64 {
+	var duration uint64
+	for _, segment := range r.Segments {
+		duration += segment.Duration
+	}
+	return float64(duration) / float64(r.Timescale)
+}
+
+// MediaTemplate is the name pattern of the segments of the representation, $Number$ starts at 1
+func (r *Representation) MediaTemplate() string {
+	return "segment_" + r.Id + "_$Number$.m4s"
+}
+
+// SegmentTrack splits the fragmented MP4 of a single track into an initialization segment and media segments
+// of about SegmentDuration, written to outputDir. The file names follow MediaTemplate.
+func SegmentTrack(track Track, outputDir string) (*Representation, error) {
+	source, err := os.Open(track.File)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file, err := readFragmentedMP4(source, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", filepath.Base(track.File), err)
+	}
+	representation := &Representation{
+		Id:          track.Id,
+		Audio:       track.Audio,
+		AudioId:     track.AudioId,
+		Codecs:      file.track.codecs,
+		Width:       file.track.width,
+		Height:      file.track.height,
+		SampleRate:  file.track.sampleRate,
+		Channels:    file.track.channels,
+		Timescale:   file.track.timescale,
+		InitSegment: "segment_" + track.Id + "_init.mp4",
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, representation.InitSegment), file.init, 0644); err != nil {
+		return nil, err
+	}
+	target := uint64(SegmentDuration * float64(file.track.timescale))
+	var pending []fragment
+	var samples int
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		segment := Segment{
+			File:  "segment_" + track.Id + "_" + strconv.Itoa(len(representation.Segments)+1) + ".m4s",
+			Start: pending[0].start,
+		}
+		for _, f := range pending {
+			segment.Duration += f.duration
+		}
+		size, err := writeSegment(filepath.Join(outputDir, segment.File), source, pending)
+		if err != nil {
+			return err
+		}
+		segment.Size = int(size)
+		representation.Segments = append(representation.Segments, segment)
+		pending = nil
+		return nil
+	}
+	var pendingDuration uint64
+	for _, f := range file.fragments {
+		if len(pending) > 0 && pendingDuration >= target && f.sync {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			pendingDuration = 0
+		}
+		pending = append(pending, f)
+		pendingDuration += f.duration
+		samples += f.samples
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	representation.Bandwidth, representation.AverageBandwidth = bandwidth(representation)
+	if !track.Audio {
+		if duration := representation.Duration(); duration > 0 {
+			representation.FrameRate = float64(samples) / duration
+		}
+	}
+	return representation, nil
+}
+
+// writeSegment copies the boxes of the fragments from the source into a new media segment behind the styp box
+// and returns the size of the segment
+func writeSegment(path string, source io.ReaderAt, fragments []fragment) (int64, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := out.Write(segmentType)
+	size := int64(written)
+	for _, f := range fragments {
+		for _, b := range f.boxes {
+			if err != nil {
+				break
+			}
+			var copied int64
+			copied, err = io.Copy(out, io.NewSectionReader(source, b.Offset, b.Size))
+			size += copied
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// segmentType is the styp box every media segment starts with, announcing a DASH media segment
+var segmentType = []byte{
+	0, 0, 0, 24, 's', 't', 'y', 'p',
+	'm', 's', 'd', 'h', 0, 0, 0, 0,
+	'm', 's', 'd', 'h', 'm', 's', 'i', 'x',
+}
+
+// bandwidth returns the peak and the average bitrate of the segments in bits per second
+func bandwidth(r *Representation) (int, int) {
+	var peak, total, duration float64
+	for _, segment := range r.Segments {
+		seconds := float64(segment.Duration) / float64(r.Timescale)
+		if seconds <= 0 {
+			continue
+		}
+		peak = math.Max(peak, float64(segment.Size*8)/seconds)
+		total += float64(segment.Size * 8)
+		duration += seconds
+	}
+	if duration == 0 {
+		return 0, 0
+	}
+	return int(math.Ceil(peak)), int(math.Ceil(total / duration))
+}
@@ -0,0 +1,134 @@
+package abr
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// initSegment writes the ftyp and moov of a single H.264 track of the given size and timescale
+func initSegment(width int, height int, timescale uint32) []byte {
+	// the visual sample entry fields, the size sits 24 bytes into them, followed by the avcC box
+	entry := make([]byte, 78)
+	copy(entry[24:], append(u16(uint16(width)), u16(uint16(height))...))
+	entry = append(entry, mkbox("avcC", []byte{1, 0x64, 0x00, 0x1f})...)
+	moov := mkbox("moov",
+		mkbox("trak",
+			mkbox("tkhd", fullBox(0, 3, make([]byte, 8), u32(1))),
+			mkbox("mdia",
+				mkbox("mdhd", fullBox(0, 0, make([]byte, 8), u32(timescale), u32(0))),
+				mkbox("hdlr", fullBox(0, 0, make([]byte, 4), []byte("vide"))),
+				mkbox("minf", mkbox("stbl", mkbox("stsd", fullBox(0, 0, u32(1), mkbox("avc1", entry))))),
+			),
+		),
+		mkbox("mvex", mkbox("trex", fullBox(0, 0, u32(1), u32(1), u32(40), u32(0), u32(0)))),
+	)
+	return append(mkbox("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41")), moov...)
+}
+
+// fragments writes a second long fragment of 25 frames for every entry of syncs, each with its media data
+func fragments(syncs ...bool) [][]byte {
+	var written [][]byte
+	for i, sync := range syncs {
+		durations := make([]uint32, 25)
+		for j := range durations {
+			durations[j] = 40
+		}
+		written = append(written, append(moof(uint64(i)*1000, durations, sync), mkbox("mdat", bytes.Repeat([]byte{byte(i)}, 100+i))...))
+	}
+	return written
+}
+
+func TestSegmentTrack(t *testing.T) {
+	dir := t.TempDir()
+	init := initSegment(640, 360, 1000)
+	fragments := fragments(true, false, true, false, false, true, true)
+	source := filepath.Join(dir, "rendition.mp4")
+	if err := os.WriteFile(source, append(init, bytes.Join(fragments, nil)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	representation, err := SegmentTrack(Track{File: source, Id: "h264_360p", AudioId: "audio_aac"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if representation.Codecs != "avc1.64001F" || representation.Width != 640 || representation.Height != 360 || representation.Timescale != 1000 {
+		t.Errorf("unexpected track properties %+v", representation)
+	}
+	if representation.FrameRate != 25 {
+		t.Errorf("got frame rate %v, want 25", representation.FrameRate)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, representation.InitSegment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, init) {
+		t.Error("the init segment is not the ftyp and moov of the source")
+	}
+	// segments are cut at the first sync sample once they are at least SegmentDuration long
+	want := []struct {
+		start     uint64
+		duration  uint64
+		fragments []int
+	}{
+		{start: 0, duration: 2000, fragments: []int{0, 1}},
+		{start: 2000, duration: 3000, fragments: []int{2, 3, 4}},
+		{start: 5000, duration: 2000, fragments: []int{5, 6}},
+	}
+	if len(representation.Segments) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(representation.Segments), len(want), representation.Segments)
+	}
+	var peak, total int
+	for i, segment := range representation.Segments {
+		if segment.Start != want[i].start || segment.Duration != want[i].duration {
+			t.Errorf("segment %d starts at %d for %d, want %d for %d", i+1, segment.Start, segment.Duration, want[i].start, want[i].duration)
+		}
+		content := append([]byte(nil), segmentType...)
+		for _, fragment := range want[i].fragments {
+			content = append(content, fragments[fragment]...)
+		}
+		written, err := os.ReadFile(filepath.Join(dir, segment.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, content) || segment.Size != len(content) {
+			t.Errorf("segment %d is not the styp box followed by its fragments", i+1)
+		}
+		bitrate := segment.Size * 8 * 1000 / int(segment.Duration)
+		peak = max(peak, bitrate)
+		total += segment.Size * 8
+	}
+	if representation.Segments[1].File != "segment_h264_360p_2.m4s" {
+		t.Errorf("got segment name %s", representation.Segments[1].File)
+	}
+	if representation.Bandwidth < peak || representation.Bandwidth > peak+1 || representation.AverageBandwidth != (total+6)/7 {
+		t.Errorf("got bandwidth %d and average %d, want %d and %d", representation.Bandwidth, representation.AverageBandwidth, peak, (total+6)/7)
+	}
+}
+
+func TestSegmentTrackMalformed(t *testing.T) {
+	init := initSegment(640, 360, 1000)
+	complete := append(append([]byte(nil), init...), bytes.Join(fragments(true, true), nil)...)
+	tests := map[string][]byte{
+		"truncated":              complete[:len(complete)-10],
+		"no movie box":           bytes.Join(fragments(true), nil),
+		"not fragmented":         append(append([]byte(nil), init...), mkbox("mdat", []byte{1, 2, 3})...),
+		"no fragments":           init,
+		"fragment before moov":   append(bytes.Join(fragments(true), nil), init...),
+		"box larger than file":   append(append([]byte(nil), init...), append(u32(1<<20), "moof"...)...),
+		"large size beyond file": append(append([]byte(nil), init...), append(append(u32(1), "mdat"...), u64(1<<62)...)...),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "rendition.mp4")
+			if err := os.WriteFile(source, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := SegmentTrack(Track{File: source, Id: "h264_360p"}, dir); !errors.Is(err, ErrMalformedMP4) {
+				t.Errorf("got %v, want %v", err, ErrMalformedMP4)
+			}
+		})
+	}
+}
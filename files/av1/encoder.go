@@ -0,0 +1,83 @@
+package av1
+
+import (
+	"strconv"
+
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/pipeline"
+)
+
+func init() {
+	pipeline.Register(svtEncoder{})
+	pipeline.Register(aomEncoder{})
+}
+
+// svtEncoder encodes AV1 with SVT-AV1, which is fast enough to run as the default AV1 encoder
+type svtEncoder struct{}
+
+func (svtEncoder) Name() string {
+	return "av1"
+}
+
+func (svtEncoder) Passes() int {
+	return 1
+}
+
+// VideoArgs encodes a rendition with a target bitrate at that average bitrate, otherwise with constant
+// quality capped at maxrate. The preset is the numeric SVT-AV1 preset.
+func (svtEncoder) VideoArgs(rung ladder.Rung) []string {
+	args := []string{"-c:v", "libsvtav1"}
+	if rung.Preset != "" {
+		args = append(args, "-preset", rung.Preset)
+	}
+	args = append(args, pipeline.AverageBitrateArgs(rung)...)
+	// SVT-AV1 takes no minimum keyframe interval, scene detection would insert keyframes between the fixed ones
+	return append(args, "-g", strconv.Itoa(rung.GOP), "-svtav1-params", "scd=0")
+}
+
+func (svtEncoder) Container() string {
+	return "mp4"
+}
+
+func (svtEncoder) Audio() pipeline.AudioCodec {
+	return pipeline.AudioCodec{Name: "opus", Encoder: "libopus"}
+}
+
+func (svtEncoder) Packaging() pipeline.PackagingHints {
+	return pipeline.PackagingHints{}
+}
+
+// aomEncoder encodes AV1 with the libaom reference encoder, slower than SVT-AV1 but at a slightly better quality
+type aomEncoder struct{}
+
+func (aomEncoder) Name() string {
+	return "av1-aom"
+}
+
+func (aomEncoder) Passes() int {
+	return 1
+}
+
+// VideoArgs encodes a rendition with a target bitrate in constrained quality mode, otherwise in constant
+// quality mode. The preset is the libaom cpu-used speed.
+func (aomEncoder) VideoArgs(rung ladder.Rung) []string {
+	speed := rung.Preset
+	if speed == "" {
+		speed = "6"
+	}
+	args := []string{"-c:v", "libaom-av1", "-cpu-used", speed, "-row-mt", "1"}
+	args = append(args, pipeline.ConstrainedQualityArgs(rung)...)
+	return append(args, pipeline.KeyframeArgs(rung)...)
+}
+
+func (aomEncoder) Container() string {
+	return "mp4"
+}
+
+func (aomEncoder) Audio() pipeline.AudioCodec {
+	return pipeline.AudioCodec{Name: "opus", Encoder: "libopus"}
+}
+
+func (aomEncoder) Packaging() pipeline.PackagingHints {
+	return pipeline.PackagingHints{}
+}
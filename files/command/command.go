@@ -0,0 +1,60 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"hangout.com/core/storage-service/exceptions"
+)
+
+// TerminateGracePeriod is how long a cancelled process gets to exit after SIGTERM before it is killed
+const TerminateGracePeriod = 10 * time.Second
+
+// stderrTailSize is how much of the end of stderr a Result and a StageError keep
+const stderrTailSize = 32 << 10
+
+// New returns a command bound to ctx. When ctx is done the process receives SIGTERM,
+// followed by SIGKILL if it is still running after TerminateGracePeriod.
+func New(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = TerminateGracePeriod
+	return cmd
+}
+
+// Cause explains a failed command. If the process was stopped because ctx is done,
+// the cancellation cause is returned wrapping the original error, so that timeouts can be told apart.
+func Cause(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", context.Cause(ctx), err)
+}
+
+// stageError turns the error of a command started with New into a StageError carrying its exit code
+// and the tail of its stderr. Returns nil if err is nil.
+func stageError(ctx context.Context, stage exceptions.Stage, detail string, err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+	stageErr := exceptions.NewStageError(stage, detail, Cause(ctx, err))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stageErr.ExitCode = exitErr.ExitCode()
+	}
+	stageErr.Stderr = tail(stderr)
+	return stageErr
+}
+
+func tail(output []byte) string {
+	if len(output) > stderrTailSize {
+		output = output[len(output)-stderrTailSize:]
+	}
+	return string(output)
+}
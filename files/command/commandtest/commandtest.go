@@ -0,0 +1,129 @@
+// Package commandtest has a command.Runner that records commands instead of running them and helpers to
+// compare them with golden files and to make synthetic media for tests that need a real ffmpeg.
+package commandtest
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// Recorder is a command.Runner that records every command it is given without running it
+type Recorder struct {
+	// Respond returns the result of a command. Without it every command succeeds without any output.
+	Respond func(cmd command.Cmd) (command.Result, error)
+
+	mu   sync.Mutex
+	cmds []command.Cmd
+}
+
+func (r *Recorder) Run(ctx context.Context, cmd command.Cmd) (command.Result, error) {
+	r.mu.Lock()
+	r.cmds = append(r.cmds, cmd)
+	r.mu.Unlock()
+	var result command.Result
+	var err error
+	if r.Respond != nil {
+		result, err = r.Respond(cmd)
+	}
+	switch {
+	case cmd.Progress != nil:
+		cmd.Progress(command.Progress{End: true})
+	case cmd.Stdout != nil:
+		cmd.Stdout.Write(result.Stdout)
+		result.Stdout = nil
+	}
+	return result, err
+}
+
+// Commands returns the recorded commands in the order they were run
+func (r *Recorder) Commands() []command.Cmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]command.Cmd(nil), r.cmds...)
+}
+
+// Format writes a command per line with its arguments quoted where a shell would need it
+func Format(cmds []command.Cmd) string {
+	var b strings.Builder
+	for _, cmd := range cmds {
+		b.WriteString(cmd.Name)
+		for _, arg := range cmd.Args {
+			b.WriteString(" " + quote(arg))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\;|&()<>*?[]{}!#~`") {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
+
+// Golden compares got with the golden file at path, or rewrites the file when the tests run with -update
+func Golden(t testing.TB, path string, got string) {
+	t.Helper()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read golden file, run the tests with -update to write it: %v", err)
+	}
+	if !bytes.Equal(want, []byte(got)) {
+		t.Errorf("%s differs from the golden file %s, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", t.Name(), path, got, want)
+	}
+}
+
+// RequireFFmpeg skips the test when ffmpeg or ffprobe is not installed
+func RequireFFmpeg(t testing.TB) {
+	t.Helper()
+	for _, program := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skip(program + " is not installed")
+		}
+	}
+}
+
+// Clip writes a short H.264 and AAC clip of the lavfi test pattern and a sine tone to a temporary directory
+// and returns its path. The test is skipped when ffmpeg is not installed.
+func Clip(t testing.TB, width int, height int, seconds int) string {
+	t.Helper()
+	RequireFFmpeg(t)
+	clip := filepath.Join(t.TempDir(), "clip.mp4")
+	duration := strconv.Itoa(seconds)
+	_, err := command.Exec{}.Run(context.Background(), command.Cmd{
+		Name: "ffmpeg",
+		Args: []string{"-y", "-v", "error",
+			"-f", "lavfi", "-i", "testsrc=size=" + strconv.Itoa(width) + "x" + strconv.Itoa(height) + ":rate=25:duration=" + duration,
+			"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000:duration=" + duration,
+			"-c:v", "libx264", "-preset", "ultrafast", "-pix_fmt", "yuv420p", "-c:a", "aac", "-shortest", clip},
+		Stage:  exceptions.StageProcess,
+		Detail: "test clip",
+	})
+	if err != nil {
+		t.Fatalf("could not generate the test clip: %v", err)
+	}
+	return clip
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProgressArgs make ffmpeg write machine readable progress reports to stdout instead of its status line to stderr.
+// They are global options and go in front of the inputs.
+var ProgressArgs = []string{"-progress", "pipe:1", "-nostats"}
+
+// Progress is one report of a running ffmpeg
+type Progress struct {
+	Frame int64
+	FPS   float64
+	// Bitrate of the output written so far in kbit/s
+	Bitrate float64
+	// OutTime is how far into the media the output has got
+	OutTime time.Duration
+	// Speed is the encoding speed relative to real time
+	Speed float64
+	// End is set on the last report, written when ffmpeg is done
+	End bool
+}
+
+// ParseProgress reads the key=value blocks ffmpeg writes with -progress and hands every complete block to report.
+// Values ffmpeg does not know yet, like N/A, are left at zero.
+func ParseProgress(r io.Reader, report func(Progress)) error {
+	scanner := bufio.NewScanner(r)
+	var current Progress
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "frame":
+			current.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			current.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			current.Bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				current.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			// every block ends with the progress key
+			current.End = value == "end"
+			if report != nil {
+				report(current)
+			}
+			current = Progress{}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,86 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"hangout.com/core/storage-service/exceptions"
+)
+
+// Cmd is an external program for a Runner to run
+type Cmd struct {
+	Name string
+	Args []string
+	// Stage and Detail describe the command in the StageError of a failure
+	Stage  exceptions.Stage
+	Detail string
+	// Progress receives the reports of an ffmpeg whose Args include ProgressArgs, stdout is read for them
+	Progress func(Progress)
+	// Stdout receives stdout while the command runs instead of it being returned in the Result. It is ignored with Progress.
+	Stdout io.Writer
+}
+
+// Result is what a command wrote
+type Result struct {
+	Stdout []byte
+	// Stderr is the end of stderr
+	Stderr []byte
+}
+
+// Runner runs external programs. The pipelines run ffmpeg and ffprobe through a Runner, so that tests can record
+// the commands instead of running them.
+type Runner interface {
+	// Run runs the command until it exits or ctx is done. A failed command returns a StageError
+	// with its exit code and the tail of its stderr.
+	Run(ctx context.Context, cmd Cmd) (Result, error)
+}
+
+// Exec is the Runner that starts the programs with New
+type Exec struct{}
+
+func (Exec) Run(ctx context.Context, c Cmd) (Result, error) {
+	var result Result
+	cmd := New(ctx, c.Name, c.Args...)
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd.Stderr = stderr
+	var stdout bytes.Buffer
+	var reports io.ReadCloser
+	var err error
+	switch {
+	case c.Progress != nil:
+		if reports, err = cmd.StdoutPipe(); err != nil {
+			return result, exceptions.NewStageError(c.Stage, c.Detail, err)
+		}
+	case c.Stdout != nil:
+		cmd.Stdout = c.Stdout
+	default:
+		cmd.Stdout = &stdout
+	}
+	if err = cmd.Start(); err != nil {
+		return result, exceptions.NewStageError(c.Stage, c.Detail, err)
+	}
+	if reports != nil {
+		// the pipe has to be drained even if a report can not be parsed, or ffmpeg blocks on it
+		if ParseProgress(reports, c.Progress) != nil {
+			io.Copy(io.Discard, reports)
+		}
+	}
+	err = cmd.Wait()
+	result.Stdout, result.Stderr = stdout.Bytes(), stderr.data
+	return result, stageError(ctx, c.Stage, c.Detail, err, stderr.data)
+}
+
+// tailBuffer keeps the last size bytes written to it
+type tailBuffer struct {
+	size int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.size:]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,9 @@
+package files
+
+// Every encoder registers itself with the pipeline when its package is loaded
+import (
+	_ "hangout.com/core/storage-service/files/av1"
+	_ "hangout.com/core/storage-service/files/h264"
+	_ "hangout.com/core/storage-service/files/hevc"
+	_ "hangout.com/core/storage-service/files/vp9"
+)
@@ -0,0 +1,138 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Tags of the first image file directory this package reads
+const (
+	tagOrientation = 0x0112
+	tagGPSInfo     = 0x8825
+)
+
+// Info is what the EXIF block of an image says about how to show it and where it was taken
+type Info struct {
+	// Orientation is the EXIF orientation from 1 to 8, 1 when the image has none
+	Orientation int
+	// HasGPS reports whether the image carries a GPS directory
+	HasGPS bool
+}
+
+// Read finds the EXIF block of a JPEG or WebP file and reads the first image file directory.
+// Files of other formats and files without EXIF return the zero orientation of 1.
+func Read(data []byte) Info {
+	info := Info{Orientation: 1}
+	tiff := find(data)
+	if len(tiff) < 8 {
+		return info
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return info
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		switch order.Uint16(tiff[entry:]) {
+		case tagOrientation:
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				info.Orientation = orientation
+			}
+		case tagGPSInfo:
+			info.HasGPS = true
+		}
+	}
+	return info
+}
+
+// find returns the TIFF structure of the EXIF block, nil if there is none
+func find(data []byte) []byte {
+	switch {
+	case len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8:
+		return findInJPEG(data)
+	case len(data) > 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return findInWebP(data)
+	}
+	return nil
+}
+
+// findInJPEG walks the markers up to the start of scan looking for the APP1 segment holding EXIF
+func findInJPEG(data []byte) []byte {
+	header := []byte("Exif\x00\x00")
+	position := 2
+	for position+4 <= len(data) {
+		if data[position] != 0xFF {
+			return nil
+		}
+		marker := data[position+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[position+2:]))
+		end := position + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[position+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, header) {
+			return segment[len(header):]
+		}
+		position = end
+	}
+	return nil
+}
+
+// findInWebP looks for the EXIF chunk of the RIFF container
+func findInWebP(data []byte) []byte {
+	position := 12
+	for position+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[position+4:]))
+		end := position + 8 + size
+		if end > len(data) {
+			return nil
+		}
+		if string(data[position:position+4]) == "EXIF" {
+			chunk := data[position+8 : end]
+			// some writers keep the JPEG style header in the chunk
+			return bytes.TrimPrefix(chunk, []byte("Exif\x00\x00"))
+		}
+		// chunks are padded to an even size
+		position = end + size%2
+	}
+	return nil
+}
+
+// Filter returns the ffmpeg filters that turn an image stored with the orientation into one shown upright.
+// Orientation 1 and unknown orientations need none.
+func Filter(orientation int) string {
+	switch orientation {
+	case 2:
+		return "hflip"
+	case 3:
+		return "hflip,vflip"
+	case 4:
+		return "vflip"
+	case 5:
+		return "transpose=cclock_flip"
+	case 6:
+		return "transpose=clock"
+	case 7:
+		return "transpose=clock_flip"
+	case 8:
+		return "transpose=cclock"
+	}
+	return ""
+}
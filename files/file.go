@@ -13,17 +13,48 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"hangout.com/core/storage-service/database"
 	"hangout.com/core/storage-service/database/model"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
 	"hangout.com/core/storage-service/files/pipeline"
+	"hangout.com/core/storage-service/files/scheduler"
+	"hangout.com/core/storage-service/files/workspace"
 	"hangout.com/core/storage-service/logger"
 )
 
+// ErrUnsupportedContentType is returned for files that no pipeline can process. Retrying them never helps.
+var ErrUnsupportedContentType = errors.New("unsupported file type received")
+
+// Lease ties a file to the kafka partition it was consumed from
+type Lease interface {
+	// Start returns false if the partition was revoked before processing started
+	Start() bool
+	// Acknowledge marks the event as consumed. Its offset is committed once every earlier event
+	// of the partition has been acknowledged as well.
+	Acknowledge()
+	// Finish releases the lease once the worker is done with the file
+	Finish()
+}
+
 type File struct {
-	Context      context.Context
-	ContentType  string
-	Filename     string
-	UserId       int32
-	KafkaMessage *sarama.ConsumerMessage
-	KafkaSession sarama.ConsumerGroupSession
+	Context       context.Context
+	ContentType   string
+	Filename      string
+	UserId        int32
+	Profile       string
+	EventId       string
+	EventSource   string
+	EventTime     time.Time
+	SchemaVersion string
+	KafkaMessage  *sarama.ConsumerMessage
+	KafkaSession  sarama.ConsumerGroupSession
+	Lease         Lease
+	// Workspace is the scratch directory of the job, set by the worker before the file is downloaded
+	Workspace *workspace.Workspace
+	// Slots are the CPU slots of the worker pool, shared by the encodes of every job
+	Slots *scheduler.Slots
+	// Runner runs the external programs of the pipelines
+	Runner command.Runner
+	Output *pipeline.Output
 }
 
 func (f *File) Process(workerContext context.Context, cfg *koanf.Koanf, dbConnPool *database.DatabaseConnectionPool, log logger.Log) error {
@@ -40,32 +71,55 @@ func (f *File) Process(workerContext context.Context, cfg *koanf.Koanf, dbConnPo
 		attribute.String("file.name", f.Filename),
 		attribute.Int("file.userId", int(f.UserId)),
 		attribute.String("file.contentType", f.ContentType),
+		attribute.String("event.id", f.EventId),
+		attribute.String("event.schemaVersion", f.SchemaVersion),
 	)
 	log = log.With("file", f.Filename, "userId", f.UserId)
-	isVideo, _ := regexp.MatchString(`^video/`, f.ContentType)
-	if !isVideo {
+	mediaFile := f.media(f.reportProgress(dbConnPool, log))
+	if mediaFile == nil {
 		log.Debug(ctx, "unsupported content type. can not process file", "contentType", f.ContentType, "file", f.Filename)
 		span.SetStatus(codes.Error, "Unsupported content type")
 		span.RecordError(errors.New("unsupported content type"))
-		return errors.New("unsupported file type received, contentType is: " + f.ContentType)
-	} else {
-		mediaFile := &pipeline.Video{Filename: f.Filename}
-		log.Info(ctx, "marking file status as PROCESSING in db", "filename", f.Filename)
-		err := dbConnPool.UpdateProcessingStatus(ctx, f.Filename, model.PROCESSING, log)
-		if err != nil {
-			log.Error(ctx, "could not mark file as PROCESSING in db", "filename", f.Filename)
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			return err
-		}
-		err = mediaFile.ProcessMedia(ctx, cfg, log)
-		if err != nil {
-			log.Error(ctx, "marking file status as FAILED in db", "filename", f.Filename)
-			dbConnPool.UpdateProcessingStatus(ctx, f.Filename, model.FAIL, log)
-			return err
+		return exceptions.NewPermanentStageError(exceptions.StageProcess, f.ContentType, ErrUnsupportedContentType)
+	}
+	log.Info(ctx, "marking file status as PROCESSING in db", "filename", f.Filename)
+	err := f.UpdateStatus(ctx, cfg, dbConnPool, model.PROCESSING, "", nil, log)
+	if err != nil {
+		log.Error(ctx, "could not mark file as PROCESSING in db", "filename", f.Filename)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	f.Output, err = mediaFile.ProcessMedia(ctx, cfg, log)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// media picks the pipeline for the content type of the file, nil if none can process it.
+// The encodes of videos and audio report their progress to progress.
+func (f *File) media(progress pipeline.ProgressFunc) pipeline.Media {
+	if isVideo, _ := regexp.MatchString(`^video/`, f.ContentType); isVideo {
+		return &pipeline.Video{Filename: f.Filename, ContentType: f.ContentType, Profile: f.Profile, Workspace: f.Workspace, Slots: f.Slots, Runner: f.Runner, Progress: progress}
+	}
+	if isImage, _ := regexp.MatchString(`^image/(jpeg|png|webp)$`, f.ContentType); isImage {
+		return &pipeline.Image{Filename: f.Filename, ContentType: f.ContentType, Workspace: f.Workspace, Slots: f.Slots, Runner: f.Runner}
+	}
+	if isAudio, _ := regexp.MatchString(`^audio/`, f.ContentType); isAudio {
+		return &pipeline.Audio{Filename: f.Filename, ContentType: f.ContentType, Workspace: f.Workspace, Slots: f.Slots, Runner: f.Runner, Progress: progress}
+	}
+	return nil
+}
+
+// reportProgress stores the progress of the job in the database for the app to poll.
+// A failed update is only logged, the encodes go on.
+func (f *File) reportProgress(dbConnPool *database.DatabaseConnectionPool, log logger.Log) pipeline.ProgressFunc {
+	return func(ctx context.Context, percent float64) {
+		if err := dbConnPool.UpdateProgress(ctx, f.Filename, percent); err != nil {
+			log.Warn(ctx, "could not store processing progress", "percent", percent, "error", err.Error())
 		}
-		log.Info(ctx, "marking file status as SUCCESS in db", "filename", f.Filename)
-		dbConnPool.UpdateProcessingStatus(ctx, f.Filename, model.SUCCESS, log)
-		return nil
 	}
 }
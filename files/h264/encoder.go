@@ -0,0 +1,45 @@
+package h264
+
+import (
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/pipeline"
+)
+
+func init() {
+	pipeline.Register(encoder{})
+}
+
+// encoder encodes H.264 with libx264, the codec every client can play
+type encoder struct{}
+
+func (encoder) Name() string {
+	return "h264"
+}
+
+func (encoder) Passes() int {
+	return 1
+}
+
+// VideoArgs encodes a rendition with a target bitrate at that average bitrate, otherwise with constant quality
+func (encoder) VideoArgs(rung ladder.Rung) []string {
+	args := []string{"-c:v", "libx264"}
+	if rung.Preset != "" {
+		args = append(args, "-preset", rung.Preset)
+	}
+	args = append(args, pipeline.AverageBitrateArgs(rung)...)
+	args = append(args, pipeline.KeyframeArgs(rung)...)
+	// no scene cut keyframes between the fixed ones
+	return append(args, "-sc_threshold", "0")
+}
+
+func (encoder) Container() string {
+	return "mp4"
+}
+
+func (encoder) Audio() pipeline.AudioCodec {
+	return pipeline.AudioCodec{Name: "aac", Encoder: "aac"}
+}
+
+func (encoder) Packaging() pipeline.PackagingHints {
+	return pipeline.PackagingHints{Fallback: true}
+}
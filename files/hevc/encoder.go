@@ -0,0 +1,45 @@
+package hevc
+
+import (
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/pipeline"
+)
+
+func init() {
+	pipeline.Register(encoder{})
+}
+
+// encoder encodes HEVC with libx265
+type encoder struct{}
+
+func (encoder) Name() string {
+	return "hevc"
+}
+
+func (encoder) Passes() int {
+	return 1
+}
+
+// VideoArgs encodes a rendition with a target bitrate at that average bitrate, otherwise with constant quality
+func (encoder) VideoArgs(rung ladder.Rung) []string {
+	args := []string{"-c:v", "libx265"}
+	if rung.Preset != "" {
+		args = append(args, "-preset", rung.Preset)
+	}
+	args = append(args, pipeline.AverageBitrateArgs(rung)...)
+	args = append(args, pipeline.KeyframeArgs(rung)...)
+	// hvc1 is the sample entry Apple players require, scene cuts would break the fixed keyframe interval
+	return append(args, "-x265-params", "scenecut=0:open-gop=0", "-tag:v", "hvc1")
+}
+
+func (encoder) Container() string {
+	return "mp4"
+}
+
+func (encoder) Audio() pipeline.AudioCodec {
+	return pipeline.AudioCodec{Name: "aac", Encoder: "aac"}
+}
+
+func (encoder) Packaging() pipeline.PackagingHints {
+	return pipeline.PackagingHints{}
+}
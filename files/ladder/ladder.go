@@ -0,0 +1,87 @@
+package ladder
+
+import (
+	"math"
+	"strconv"
+
+	"hangout.com/core/storage-service/files/probe"
+)
+
+// SegmentSeconds is the length of a DASH segment. Every rendition puts a keyframe at the start of each segment.
+const SegmentSeconds = 2
+
+// defaultFrameRate is assumed when ffprobe could not tell the frame rate of the source
+const defaultFrameRate = 30
+
+// Rung is a single video rendition of the ladder, sized for a particular source
+type Rung struct {
+	// Name is the short edge followed by p, for example 720p
+	Name   string
+	Width  int
+	Height int
+	// GOP is the keyframe interval in frames
+	GOP int
+	Spec
+}
+
+// Id identifies the rendition among all renditions of the ladder
+func (r Rung) Id() string {
+	return r.Codec + "_" + r.Name
+}
+
+// For builds the rendition ladder of a source video from a profile.
+// Rungs keep the aspect ratio of the source as it is displayed, so rotated phone videos stay upright,
+// and rungs above the source are skipped so nothing is ever upscaled. A source that falls between two
+// rungs additionally gets a rendition at its own size, encoded like the next lower rung.
+// Every codec of the profile gets its own ladder.
+func For(metadata *probe.Metadata, profile Profile) []Rung {
+	source := even(metadata.ShortEdge())
+	var rungs []Rung
+	for _, codec := range profile.Codecs() {
+		var specs []Spec
+		for _, spec := range profile.Renditions {
+			if spec.Codec == codec {
+				specs = append(specs, spec)
+			}
+		}
+		var codecRungs []Rung
+		for _, spec := range specs {
+			if spec.Height > source {
+				break
+			}
+			codecRungs = append(codecRungs, scale(metadata, spec.Height, spec))
+		}
+		last := specs[0]
+		if len(codecRungs) > 0 {
+			last = codecRungs[len(codecRungs)-1].Spec
+		}
+		if len(codecRungs) == 0 || (last.Height < source && source < specs[len(specs)-1].Height) {
+			codecRungs = append(codecRungs, scale(metadata, source, last))
+		}
+		rungs = append(rungs, codecRungs...)
+	}
+	return rungs
+}
+
+// GOP returns the keyframe interval in frames for an interval in seconds at the given frame rate
+func GOP(frameRate float64, seconds float64) int {
+	if frameRate <= 0 {
+		frameRate = defaultFrameRate
+	}
+	return max(1, int(math.Round(frameRate*seconds)))
+}
+
+func scale(metadata *probe.Metadata, shortEdge int, spec Spec) Rung {
+	spec.Height = shortEdge
+	longEdge := even(int(math.Round(float64(max(metadata.Width, metadata.Height)) * float64(shortEdge) / float64(metadata.ShortEdge()))))
+	rung := Rung{Name: strconv.Itoa(shortEdge) + "p", Width: longEdge, Height: shortEdge, GOP: GOP(metadata.FrameRate, spec.GOP.Seconds()), Spec: spec}
+	if metadata.Portrait() {
+		rung.Width, rung.Height = shortEdge, longEdge
+	}
+	return rung
+}
+
+// even rounds down to the next even number, most encoders reject odd dimensions
+func even(n int) int {
+	return max(2, n-n%2)
+}
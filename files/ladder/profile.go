@@ -0,0 +1,195 @@
+package ladder
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/files/abr"
+)
+
+// Manifest layouts of a profile with more than one codec
+const (
+	// ManifestsCombined puts every codec into one manifest as separate adaptation sets
+	ManifestsCombined = "combined"
+	// ManifestsPerCodec writes the fallback codecs to the main manifest and every other codec to a sibling manifest
+	ManifestsPerCodec = "per-codec"
+)
+
+// Execution modes of a profile
+const (
+	// ExecutionPerRendition runs an ffmpeg process per rendition and audio track, each decoding the source
+	ExecutionPerRendition = "per-rendition"
+	// ExecutionSingleDecode decodes the source once and encodes every rendition and audio track from it in one ffmpeg process
+	ExecutionSingleDecode = "single-decode"
+)
+
+// DefaultProfile is used when neither the event nor its content type select a profile
+// and process.default-ladder is not set
+const DefaultProfile = "default"
+
+// Spec is a single rendition of a profile as it is configured under process.ladders
+type Spec struct {
+	// Height is the short edge of the rendition, so a 720 rendition of a portrait video is 720x1280
+	Height int
+	Codec  string
+	// CRF selects constant quality encoding. Bitrate is used instead when it is set.
+	CRF     int
+	Bitrate string
+	Maxrate string
+	Bufsize string
+	// GOP is the keyframe interval, it should divide the segment length
+	GOP          time.Duration
+	Preset       string
+	AudioBitrate string
+}
+
+// Profile is a named encoding ladder
+type Profile struct {
+	Name       string
+	Renditions []Spec
+	// Manifests is the manifest layout, one of ManifestsCombined or ManifestsPerCodec
+	Manifests string
+	// Formats are the playlist formats every manifest is written in, abr.DASH and abr.HLS
+	Formats []string
+	// Execution is how the renditions are encoded, ExecutionPerRendition or ExecutionSingleDecode
+	Execution string
+}
+
+// builtin is the ladder used when process.ladders does not define the selected profile
+var builtin = Profile{
+	Name:      DefaultProfile,
+	Manifests: ManifestsCombined,
+	Formats:   []string{abr.DASH},
+	Execution: ExecutionPerRendition,
+	Renditions: []Spec{
+		{Height: 360, Codec: "h264", CRF: 25, GOP: SegmentSeconds * time.Second, Preset: "slow", AudioBitrate: "128k"},
+		{Height: 720, Codec: "h264", CRF: 25, GOP: SegmentSeconds * time.Second, Preset: "slow", AudioBitrate: "128k"},
+		{Height: 1080, Codec: "h264", CRF: 25, GOP: SegmentSeconds * time.Second, Preset: "slow", AudioBitrate: "128k"},
+	},
+}
+
+// Select picks the profile for a file. A profile named in the event wins over one configured for the
+// content type in process.ladder-selection, which wins over process.default-ladder.
+func Select(cfg *koanf.Koanf, contentType string, hint string) (Profile, error) {
+	name := cfg.String("process.default-ladder")
+	if name == "" {
+		name = DefaultProfile
+	}
+	for _, selection := range cfg.Slices("process.ladder-selection") {
+		if selection.String("content-type") == contentType && selection.String("profile") != "" {
+			name = selection.String("profile")
+			break
+		}
+	}
+	if hint != "" && cfg.Exists("process.ladders."+hint) {
+		name = hint
+	}
+	return Load(cfg, name)
+}
+
+// Load reads the profile with the given name from process.ladders.
+// Renditions are returned from the lowest to the highest.
+func Load(cfg *koanf.Koanf, name string) (Profile, error) {
+	key := "process.ladders." + name
+	if !cfg.Exists(key) {
+		if name == DefaultProfile {
+			return builtin, nil
+		}
+		return Profile{}, fmt.Errorf("ladder profile %q is not configured", name)
+	}
+	profile := Profile{Name: name, Manifests: cfg.String(key + ".manifests")}
+	switch profile.Manifests {
+	case "":
+		profile.Manifests = ManifestsCombined
+	case ManifestsCombined, ManifestsPerCodec:
+	default:
+		return Profile{}, fmt.Errorf("ladder profile %q has unknown manifest layout %q", name, profile.Manifests)
+	}
+	profile.Formats = cfg.Strings(key + ".formats")
+	if len(profile.Formats) == 0 {
+		profile.Formats = []string{abr.DASH}
+	}
+	for _, format := range profile.Formats {
+		if format != abr.DASH && format != abr.HLS {
+			return Profile{}, fmt.Errorf("ladder profile %q has unknown playlist format %q", name, format)
+		}
+	}
+	profile.Execution = cfg.String(key + ".execution")
+	switch profile.Execution {
+	case "":
+		profile.Execution = ExecutionPerRendition
+	case ExecutionPerRendition, ExecutionSingleDecode:
+	default:
+		return Profile{}, fmt.Errorf("ladder profile %q has unknown execution mode %q", name, profile.Execution)
+	}
+	for i, rendition := range cfg.Slices(key + ".renditions") {
+		spec := Spec{
+			Height:       rendition.Int("height"),
+			Codec:        rendition.String("codec"),
+			CRF:          rendition.Int("crf"),
+			Bitrate:      rendition.String("bitrate"),
+			Maxrate:      rendition.String("maxrate"),
+			Bufsize:      rendition.String("bufsize"),
+			GOP:          rendition.Duration("gop"),
+			Preset:       rendition.String("preset"),
+			AudioBitrate: rendition.String("audio-bitrate"),
+		}
+		if spec.Height <= 0 || spec.Codec == "" {
+			return Profile{}, fmt.Errorf("rendition %d of ladder profile %q needs a height and a codec", i, name)
+		}
+		if spec.GOP <= 0 {
+			spec.GOP = SegmentSeconds * time.Second
+		}
+		profile.Renditions = append(profile.Renditions, spec)
+	}
+	if len(profile.Renditions) == 0 {
+		return Profile{}, fmt.Errorf("ladder profile %q has no renditions", name)
+	}
+	slices.SortStableFunc(profile.Renditions, func(a, b Spec) int { return cmp.Compare(a.Height, b.Height) })
+	return profile, nil
+}
+
+// Codecs returns the video codecs of the profile in the order they first appear
+func (p Profile) Codecs() []string {
+	var codecs []string
+	for _, spec := range p.Renditions {
+		if !slices.Contains(codecs, spec.Codec) {
+			codecs = append(codecs, spec.Codec)
+		}
+	}
+	return codecs
+}
+
+// AudioBitrate returns the highest audio bitrate of the renditions, the audio track is shared between them
+func (p Profile) AudioBitrate() string {
+	bitrate := ""
+	for _, spec := range p.Renditions {
+		if spec.AudioBitrate != "" && bitrateValue(spec.AudioBitrate) > bitrateValue(bitrate) {
+			bitrate = spec.AudioBitrate
+		}
+	}
+	return bitrate
+}
+
+// bitrateValue converts an ffmpeg style bitrate like 128k or 2.5M to bits per second
+func bitrateValue(bitrate string) float64 {
+	if bitrate == "" {
+		return 0
+	}
+	multiplier := 1.0
+	switch bitrate[len(bitrate)-1] {
+	case 'k', 'K':
+		multiplier = 1e3
+	case 'm', 'M':
+		multiplier = 1e6
+	}
+	if multiplier != 1 {
+		bitrate = bitrate[:len(bitrate)-1]
+	}
+	var value float64
+	fmt.Sscanf(bitrate, "%g", &value)
+	return value * multiplier
+}
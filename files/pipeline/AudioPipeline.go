@@ -0,0 +1,425 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/abr"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/postprocess"
+	"hangout.com/core/storage-service/files/probe"
+	"hangout.com/core/storage-service/files/scheduler"
+	"hangout.com/core/storage-service/files/workspace"
+	"hangout.com/core/storage-service/logger"
+)
+
+// Progressive is the output format of plain audio files that players download as a whole instead of streaming them
+const Progressive = "progressive"
+
+type Audio struct {
+	Filename    string
+	ContentType string
+	// Workspace holds the downloaded source and the output folder
+	Workspace *workspace.Workspace
+	// Slots are the CPU slots the encodes share with every other job of the process
+	Slots *scheduler.Slots
+	// Runner runs ffmpeg and ffprobe
+	Runner command.Runner
+	// Progress receives the progress of the encodes, if set
+	Progress ProgressFunc
+}
+
+// audioRendition is a rung of the audio ladder
+type audioRendition struct {
+	codec   string
+	bitrate string
+}
+
+// id names the files of the rendition, for example aac_128k
+func (r audioRendition) id() string {
+	return r.codec + "_" + r.bitrate
+}
+
+// audioSettings are the loudness target, the ladder and the output formats of audio files, from process.audio
+type audioSettings struct {
+	// loudness is the integrated loudness target in LUFS, truePeak the ceiling in dBTP and loudnessRange in LU
+	loudness       float64
+	truePeak       float64
+	loudnessRange  float64
+	renditions     []audioRendition
+	formats        []string
+	waveformPoints int
+}
+
+// defaultAudioSettings are used for every setting process.audio leaves out.
+// The loudness target is the one of EBU R128.
+var defaultAudioSettings = audioSettings{
+	loudness:      -23,
+	truePeak:      -1,
+	loudnessRange: 11,
+	renditions: []audioRendition{
+		{codec: "aac", bitrate: "64k"},
+		{codec: "aac", bitrate: "128k"},
+		{codec: "opus", bitrate: "48k"},
+		{codec: "opus", bitrate: "96k"},
+	},
+	formats:        []string{abr.DASH, abr.HLS, Progressive},
+	waveformPoints: 1000,
+}
+
+// audioCodecs are the codecs of the audio ladder
+var audioCodecs = map[string]AudioCodec{
+	"aac":  {Name: "aac", Encoder: "aac"},
+	"opus": {Name: "opus", Encoder: "libopus"},
+}
+
+// progressiveContainers are the file extensions progressive files of a codec are written with
+var progressiveContainers = map[string]string{
+	"aac":  ".m4a",
+	"opus": ".webm",
+}
+
+// waveformSampleRate is the rate the audio is resampled to before its peaks are measured
+const waveformSampleRate = 8000
+
+func loadAudioSettings(cfg *koanf.Koanf) (audioSettings, error) {
+	settings := defaultAudioSettings
+	if cfg.Get("process.audio.integrated-loudness") != nil {
+		settings.loudness = cfg.Float64("process.audio.integrated-loudness")
+	}
+	if cfg.Get("process.audio.true-peak") != nil {
+		settings.truePeak = cfg.Float64("process.audio.true-peak")
+	}
+	if loudnessRange := cfg.Float64("process.audio.loudness-range"); loudnessRange > 0 {
+		settings.loudnessRange = loudnessRange
+	}
+	if points := cfg.Int("process.audio.waveform-points"); points > 0 {
+		settings.waveformPoints = points
+	}
+	if formats := cfg.Strings("process.audio.formats"); len(formats) > 0 {
+		settings.formats = formats
+	}
+	for _, format := range settings.formats {
+		if format != abr.DASH && format != abr.HLS && format != Progressive {
+			return settings, fmt.Errorf("unknown audio output format %q", format)
+		}
+	}
+	if renditions := cfg.Slices("process.audio.renditions"); len(renditions) > 0 {
+		settings.renditions = nil
+		for i, rendition := range renditions {
+			r := audioRendition{codec: rendition.String("codec"), bitrate: rendition.String("bitrate")}
+			if _, ok := audioCodecs[r.codec]; !ok || r.bitrate == "" {
+				return settings, fmt.Errorf("audio rendition %d needs a bitrate and one of the codecs aac or opus", i)
+			}
+			settings.renditions = append(settings.renditions, r)
+		}
+	}
+	return settings, nil
+}
+
+func (a *Audio) ProcessMedia(ctx context.Context, cfg *koanf.Koanf, log logger.Log) (*Output, error) {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "ProcessAudio")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("audio.filename", a.Filename),
+		attribute.String("audio.contentType", a.ContentType),
+	)
+	inputFile := a.Workspace.Source()
+	outputFolder := a.Workspace.Output()
+	filename := a.Workspace.Name()
+	settings, err := loadAudioSettings(cfg)
+	if err != nil {
+		log.Error(ctx, "could not load audio settings", "error", err.Error())
+		return nil, exceptions.NewPermanentStageError(exceptions.StageProcess, "audio settings", err)
+	}
+	probeCtx, cancel := stageContext(ctx, cfg, "probe")
+	metadata, err := probe.ProbeAudio(probeCtx, a.Runner, inputFile)
+	cancel()
+	if err != nil {
+		log.Error(ctx, "could not probe audio", "error", err.Error())
+		return nil, err
+	}
+	log.Info(ctx, "probed audio", "codec", metadata.AudioCodec, "sampleRate", metadata.AudioSampleRate, "channels", metadata.AudioChannels, "duration", metadata.DurationSeconds)
+	output := &Output{DurationSeconds: metadata.DurationSeconds}
+	files, err := processAudio(ctx, cfg, a.Runner, a.Slots, inputFile, outputFolder, filename, metadata, settings, output, newProgressTracker(cfg, metadata.DurationSeconds, a.Progress), log)
+	if err != nil {
+		log.Error(ctx, "error in audio processing pipeline", "error", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	postprocess.CleanUp(ctx, inputFile, files, log)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// processAudio normalizes the loudness of the source into a lossless intermediate, encodes the ladder from it
+// in parallel, measures the waveform and packages the renditions as playlists and progressive files. It fills in the output
+// and returns the intermediate files it wrote.
+func processAudio(ctx context.Context, cfg *koanf.Koanf, runner command.Runner, slots *scheduler.Slots, inputFilePath string, outputFolder string, filename string, metadata *probe.Metadata, settings audioSettings, output *Output, progress *progressTracker, log logger.Log) ([]string, error) {
+	outputFilePath := outputFolder + "/" + filename
+	normalized := outputFilePath + "_normalized.flac"
+	files := []string{normalized}
+	var tracks []abr.Track
+	var codecs []string
+	for _, rendition := range settings.renditions {
+		file := outputFilePath + "_audio_" + rendition.id() + ".mp4"
+		files = append(files, file)
+		tracks = append(tracks, abr.Track{File: file, Id: "audio_" + rendition.id(), Audio: true})
+		if !slices.Contains(codecs, rendition.codec) {
+			codecs = append(codecs, rendition.codec)
+		}
+		output.Renditions = append(output.Renditions, Rendition{Name: rendition.bitrate, Codec: rendition.codec, Type: "audio"})
+	}
+	var streaming []string
+	for _, format := range settings.formats {
+		if format != Progressive {
+			streaming = append(streaming, format)
+			output.Manifests = append(output.Manifests, Manifest{Name: filename + abr.Extension(format), Format: format, Codecs: codecs})
+		}
+	}
+	if len(output.Manifests) > 0 {
+		output.Manifest = output.Manifests[0].Name
+	}
+	// the renditions and the waveform are made from the normalized audio side by side, packaging waits for the renditions
+	tasks := []scheduler.Task{stageTask(cfg, "audio", "normalize", nil, func(ctx context.Context) error {
+		return normalizeLoudness(ctx, runner, inputFilePath, normalized, settings, progress, log)
+	})}
+	var encodes []string
+	for i, rendition := range settings.renditions {
+		tasks = append(tasks, stageTask(cfg, "audio", "audio_"+rendition.id(), []string{"normalize"}, func(ctx context.Context) error {
+			return encodeAudio(ctx, runner, normalized, tracks[i].File, audioCodecs[rendition.codec], rendition.bitrate, progress, "audio_"+rendition.id(), log)
+		}))
+		encodes = append(encodes, "audio_"+rendition.id())
+	}
+	output.Waveform = "waveform.json"
+	tasks = append(tasks, stageTask(cfg, "audio", "waveform", []string{"normalize"}, func(ctx context.Context) error {
+		return createWaveform(ctx, runner, normalized, outputFolder+"/"+output.Waveform, metadata.DurationSeconds, settings.waveformPoints)
+	}))
+	packaging := stageTask(cfg, "package", "package", encodes, func(ctx context.Context) error {
+		if len(streaming) > 0 {
+			if err := abr.CreatePlaylist(ctx, outputFilePath, tracks, streaming, log); err != nil {
+				return err
+			}
+		}
+		if !slices.Contains(settings.formats, Progressive) {
+			return nil
+		}
+		for i, rendition := range settings.renditions {
+			progressive, err := remuxProgressive(ctx, runner, tracks[i].File, outputFolder, rendition)
+			if err != nil {
+				return err
+			}
+			output.Progressive = append(output.Progressive, progressive)
+		}
+		return nil
+	})
+	// packaging and remuxing only copy data
+	packaging.Slots = 0
+	progress.track(append([]string{"normalize"}, encodes...))
+	if err := scheduler.Run(ctx, append(tasks, packaging), jobConcurrency(cfg), slots); err != nil {
+		return files, err
+	}
+	log.Info(ctx, "pipeline checkpoint", "file", inputFilePath, "status", "finished processing")
+	return files, nil
+}
+
+// loudnessMeasurement is the JSON summary the first pass of the ffmpeg loudnorm filter prints to stderr
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// normalizeLoudness measures the loudness of the source in a first pass and corrects it linearly to the target
+// in a second pass, as the single pass loudnorm filter compresses the dynamics. Silent sources are written unchanged.
+func normalizeLoudness(ctx context.Context, runner command.Runner, inputFilePath string, normalized string, settings audioSettings, progress *progressTracker, log logger.Log) error {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "NormalizeLoudness")
+	defer span.End()
+	target := "I=" + formatFloat(settings.loudness) + ":TP=" + formatFloat(settings.truePeak) + ":LRA=" + formatFloat(settings.loudnessRange)
+	result, err := runner.Run(ctx, command.Cmd{
+		Name:   "ffmpeg",
+		Args:   []string{"-hide_banner", "-nostats", "-i", inputFilePath, "-vn", "-af", "loudnorm=" + target + ":print_format=json", "-f", "null", "-"},
+		Stage:  exceptions.StageAudio,
+		Detail: "loudness measurement",
+	})
+	if err != nil {
+		return err
+	}
+	filter := ""
+	measurement, err := parseLoudness(result.Stderr)
+	if err != nil {
+		log.Info(ctx, "audio has no measurable loudness, it is left as it is", "error", err.Error())
+	} else {
+		span.SetAttributes(
+			attribute.String("loudness.input", measurement.InputI),
+			attribute.String("loudness.truePeak", measurement.InputTP),
+			attribute.String("loudness.range", measurement.InputLRA),
+		)
+		log.Debug(ctx, "measured loudness", "integrated", measurement.InputI, "truePeak", measurement.InputTP, "range", measurement.InputLRA)
+		filter = "loudnorm=" + target +
+			":measured_I=" + measurement.InputI + ":measured_TP=" + measurement.InputTP +
+			":measured_LRA=" + measurement.InputLRA + ":measured_thresh=" + measurement.InputThresh +
+			":offset=" + measurement.TargetOffset + ":linear=true"
+	}
+	args := append(slices.Clone(command.ProgressArgs), "-y", "-i", inputFilePath, "-vn")
+	if filter != "" {
+		args = append(args, "-af", filter)
+	}
+	// loudnorm works at 192 kHz, the ladder is encoded at the rate both codecs support
+	_, err = runner.Run(ctx, command.Cmd{
+		Name:     "ffmpeg",
+		Args:     append(args, "-ar", "48000", normalized),
+		Stage:    exceptions.StageAudio,
+		Detail:   "loudness normalization",
+		Progress: progress.encode(ctx, "normalize", 1, 1),
+	})
+	return err
+}
+
+// parseLoudness reads the measurement from the stderr of the loudnorm filter, the last JSON object in it
+func parseLoudness(out []byte) (loudnessMeasurement, error) {
+	var measurement loudnessMeasurement
+	start, end := bytes.LastIndexByte(out, '{'), bytes.LastIndexByte(out, '}')
+	if start < 0 || end < start {
+		return measurement, errors.New("no loudness measurement in the ffmpeg output")
+	}
+	if err := json.Unmarshal(out[start:end+1], &measurement); err != nil {
+		return measurement, err
+	}
+	for _, value := range []string{measurement.InputI, measurement.InputTP, measurement.InputLRA, measurement.InputThresh, measurement.TargetOffset} {
+		if v, err := strconv.ParseFloat(value, 64); err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+			return measurement, fmt.Errorf("loudness measurement %q is not finite", value)
+		}
+	}
+	return measurement, nil
+}
+
+// waveform is the peaks file the player draws, in the JSON format of audiowaveform with 8 bit values.
+// Data holds a minimum and a maximum for every point.
+type waveform struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// createWaveform decodes the audio to mono at a low rate and keeps the minimum and maximum of every slice of it,
+// so that the file has about the requested number of points however long the audio is
+func createWaveform(ctx context.Context, runner command.Runner, normalized string, waveformFile string, duration float64, points int) error {
+	samplesPerPoint := max(1, int(math.Ceil(duration*waveformSampleRate/float64(points))))
+	peaks := &peakWriter{samplesPerPoint: samplesPerPoint}
+	peaks.reset()
+	_, err := runner.Run(ctx, command.Cmd{
+		Name:   "ffmpeg",
+		Args:   []string{"-v", "error", "-i", normalized, "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "-"},
+		Stage:  exceptions.StageAudio,
+		Detail: "waveform",
+		Stdout: peaks,
+	})
+	if err != nil {
+		return err
+	}
+	data := peaks.finish()
+	content, err := json.Marshal(waveform{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      waveformSampleRate,
+		SamplesPerPixel: samplesPerPoint,
+		Bits:            8,
+		Length:          len(data) / 2,
+		Data:            data,
+	})
+	if err == nil {
+		err = os.WriteFile(waveformFile, content, 0644)
+	}
+	if err != nil {
+		return exceptions.NewStageError(exceptions.StageAudio, "waveform", err)
+	}
+	return nil
+}
+
+// peakWriter keeps the minimum and maximum of every samplesPerPoint 16 bit samples written to it, as 8 bit values
+type peakWriter struct {
+	samplesPerPoint int
+	data            []int8
+	low, high       int8
+	count           int
+	// odd holds the first byte of a sample split between two writes
+	odd    byte
+	hasOdd bool
+}
+
+func (w *peakWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.hasOdd && len(p) > 0 {
+		w.add([2]byte{w.odd, p[0]})
+		p, w.hasOdd = p[1:], false
+	}
+	for ; len(p) >= 2; p = p[2:] {
+		w.add([2]byte{p[0], p[1]})
+	}
+	if len(p) == 1 {
+		w.odd, w.hasOdd = p[0], true
+	}
+	return n, nil
+}
+
+func (w *peakWriter) add(sample [2]byte) {
+	value := int8(int16(binary.LittleEndian.Uint16(sample[:])) >> 8)
+	w.low, w.high = min(w.low, value), max(w.high, value)
+	w.count++
+	if w.count == w.samplesPerPoint {
+		w.data = append(w.data, w.low, w.high)
+		w.reset()
+	}
+}
+
+func (w *peakWriter) reset() {
+	w.low, w.high, w.count = int8(math.MaxInt8), int8(math.MinInt8), 0
+}
+
+// finish returns the peaks, including the last point if it has fewer samples than the others
+func (w *peakWriter) finish() []int8 {
+	if w.count > 0 {
+		w.data = append(w.data, w.low, w.high)
+		w.reset()
+	}
+	return w.data
+}
+
+// remuxProgressive copies an encoded rendition into a plain file that starts playing before it is fully downloaded
+func remuxProgressive(ctx context.Context, runner command.Runner, track string, outputFolder string, rendition audioRendition) (ProgressiveFile, error) {
+	progressive := ProgressiveFile{Name: "audio_" + rendition.id() + progressiveContainers[rendition.codec], Codec: rendition.codec, Bitrate: rendition.bitrate}
+	args := []string{"-y", "-i", track, "-c", "copy"}
+	if rendition.codec == "aac" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	_, err := runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: append(args, outputFolder+"/"+progressive.Name), Stage: exceptions.StagePackage, Detail: progressive.Name})
+	return progressive, err
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,225 @@
+package pipeline
+
+import (
+	"context"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/blurhash"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/exif"
+	"hangout.com/core/storage-service/files/postprocess"
+	"hangout.com/core/storage-service/files/scheduler"
+	"hangout.com/core/storage-service/files/workspace"
+	"hangout.com/core/storage-service/logger"
+)
+
+type Image struct {
+	Filename    string
+	ContentType string
+	// Workspace holds the downloaded source and the output folder
+	Workspace *workspace.Workspace
+	// Slots are the CPU slots the conversions share with every other job of the process
+	Slots *scheduler.Slots
+	// Runner runs ffmpeg
+	Runner command.Runner
+}
+
+// imageSettings are the widths and formats of the variants of an image, from process.images
+type imageSettings struct {
+	widths  []int
+	formats []string
+}
+
+// defaultImageSettings are used for every setting process.images leaves out
+var defaultImageSettings = imageSettings{
+	widths:  []int{320, 640, 1280, 2048},
+	formats: []string{"avif", "webp", "jpg"},
+}
+
+// placeholderSize is the long edge of the picture the blurhash is computed from
+const placeholderSize = 32
+
+func loadImageSettings(cfg *koanf.Koanf) imageSettings {
+	settings := defaultImageSettings
+	if widths := cfg.Ints("process.images.widths"); len(widths) > 0 {
+		settings.widths = widths
+	}
+	if formats := cfg.Strings("process.images.formats"); len(formats) > 0 {
+		settings.formats = formats
+	}
+	return settings
+}
+
+func (i *Image) ProcessMedia(ctx context.Context, cfg *koanf.Koanf, log logger.Log) (*Output, error) {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "ProcessImage")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("image.filename", i.Filename),
+		attribute.String("image.contentType", i.ContentType),
+	)
+	inputFile := i.Workspace.Source()
+	outputFolder := i.Workspace.Output()
+	imageCtx, cancel := stageContext(ctx, cfg, "image")
+	defer cancel()
+	output, files, err := processImage(imageCtx, i.Runner, i.Slots, jobConcurrency(cfg), inputFile, outputFolder, loadImageSettings(cfg), log)
+	if err != nil {
+		log.Error(ctx, "error in image processing pipeline", "error", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	postprocess.CleanUp(ctx, inputFile, files, log)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// processImage turns the image upright into a lossless intermediate without any metadata, which drops
+// the GPS location along with the rest of EXIF, and writes every variant and the placeholder from it.
+// Every conversion holds a CPU slot, up to concurrency of them run at the same time.
+// It returns the output and the intermediate files it wrote.
+func processImage(ctx context.Context, runner command.Runner, slots *scheduler.Slots, concurrency int, inputFilePath string, outputFolder string, settings imageSettings, log logger.Log) (*Output, []string, error) {
+	span := trace.SpanFromContext(ctx)
+	data, err := os.ReadFile(inputFilePath)
+	if err != nil {
+		return nil, nil, exceptions.NewStageError(exceptions.StageProcess, "read image", err)
+	}
+	info := exif.Read(data)
+	span.SetAttributes(
+		attribute.Int("image.orientation", info.Orientation),
+		attribute.Bool("image.gps", info.HasGPS),
+	)
+	if info.HasGPS {
+		log.Info(ctx, "image carries a GPS location, it is left out of every variant")
+	}
+	normalized := filepath.Join(outputFolder, "normalized.png")
+	placeholder := filepath.Join(outputFolder, "placeholder.png")
+	files := []string{normalized, placeholder}
+	// the EXIF orientation is applied here, whether or not the decoder knows about it
+	args := []string{"-y", "-noautorotate", "-i", inputFilePath, "-frames:v", "1", "-map_metadata", "-1"}
+	if filter := exif.Filter(info.Orientation); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	decode := scheduler.Task{Name: "decode", Slots: 1, Run: func(ctx context.Context) error {
+		_, err := runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: append(args, normalized), Stage: exceptions.StageProcess, Detail: "decode image"})
+		return err
+	}}
+	if err = scheduler.Run(ctx, []scheduler.Task{decode}, 1, slots); err != nil {
+		return nil, files, err
+	}
+	width, height, err := pictureSize(normalized)
+	if err != nil {
+		return nil, files, exceptions.NewPermanentStageError(exceptions.StageProcess, "decode image", err)
+	}
+	log.Info(ctx, "decoded image", "width", width, "height", height, "orientation", info.Orientation)
+	output := &Output{}
+	var tasks []scheduler.Task
+	for _, variantWidth := range variantWidths(settings.widths, width) {
+		for _, format := range settings.formats {
+			// every variant has a place of its own, so the order does not depend on which finishes first
+			index := len(output.Variants)
+			output.Variants = append(output.Variants, StillImage{})
+			tasks = append(tasks, scheduler.Task{Name: "image_" + strconv.Itoa(variantWidth) + "." + format, Slots: 1, Run: func(ctx context.Context) error {
+				variant, err := createVariant(ctx, runner, normalized, outputFolder, width, height, variantWidth, format)
+				if err != nil {
+					log.Error(ctx, "error in creating image variant", "width", variantWidth, "format", format, "error", err.Error())
+					return err
+				}
+				output.Variants[index] = variant
+				return nil
+			}})
+		}
+	}
+	tasks = append(tasks, scheduler.Task{Name: "placeholder", Slots: 1, Run: func(ctx context.Context) error {
+		var err error
+		output.Blurhash, err = createPlaceholder(ctx, runner, normalized, placeholder, width, height)
+		if err != nil {
+			log.Error(ctx, "error in creating placeholder", "error", err.Error())
+		}
+		return err
+	}})
+	if err = scheduler.Run(ctx, tasks, concurrency, slots); err != nil {
+		return nil, files, err
+	}
+	log.Info(ctx, "pipeline checkpoint", "status", "finished processing", "variants", len(output.Variants))
+	return output, files, nil
+}
+
+// variantWidths drops the widths above the source, images are never upscaled. A source narrower
+// than every width gets a single variant of its own width.
+func variantWidths(widths []int, sourceWidth int) []int {
+	var fitting []int
+	for _, width := range widths {
+		if width <= sourceWidth {
+			fitting = append(fitting, width)
+		}
+	}
+	if len(fitting) == 0 {
+		return []int{sourceWidth}
+	}
+	return fitting
+}
+
+func createVariant(ctx context.Context, runner command.Runner, normalized string, outputFolder string, sourceWidth int, sourceHeight int, width int, format string) (StillImage, error) {
+	variant := StillImage{Name: "image_" + strconv.Itoa(width) + "." + format, Format: format, Width: width, Height: scaledHeight(sourceWidth, sourceHeight, width)}
+	codecArgs, err := stillImageArgs(format)
+	if err != nil {
+		return variant, exceptions.NewPermanentStageError(exceptions.StageProcess, "image variant", err)
+	}
+	args := append([]string{"-y", "-i", normalized, "-vf", scaleFilter(variant.Width, variant.Height)}, codecArgs...)
+	_, err = runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: append(args, filepath.Join(outputFolder, variant.Name)), Stage: exceptions.StageProcess, Detail: variant.Name})
+	return variant, err
+}
+
+// createPlaceholder computes the blurhash of a tiny copy of the image, with more components along its long edge
+func createPlaceholder(ctx context.Context, runner command.Runner, normalized string, placeholder string, width int, height int) (string, error) {
+	placeholderWidth, placeholderHeight := placeholderSize, max(1, placeholderSize*height/width)
+	xComponents, yComponents := 4, 3
+	if height > width {
+		placeholderWidth, placeholderHeight = max(1, placeholderSize*width/height), placeholderSize
+		xComponents, yComponents = 3, 4
+	}
+	filter := scaleFilter(placeholderWidth, placeholderHeight)
+	_, err := runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: []string{"-y", "-i", normalized, "-vf", filter, placeholder}, Stage: exceptions.StageProcess, Detail: "placeholder"})
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(placeholder)
+	if err != nil {
+		return "", exceptions.NewStageError(exceptions.StageProcess, "placeholder", err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return "", exceptions.NewStageError(exceptions.StageProcess, "placeholder", err)
+	}
+	hash, err := blurhash.Encode(img, xComponents, yComponents)
+	if err != nil {
+		return "", exceptions.NewStageError(exceptions.StageProcess, "placeholder", err)
+	}
+	return hash, nil
+}
+
+// pictureSize reads the dimensions of a PNG file without decoding its pixels
+func pictureSize(path string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	config, err := png.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
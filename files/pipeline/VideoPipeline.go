@@ -2,87 +2,284 @@ package pipeline
 
 import (
 	"context"
-	"os"
-	"strings"
+	"slices"
 
 	"github.com/knadh/koanf/v2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"hangout.com/core/storage-service/exceptions"
 	"hangout.com/core/storage-service/files/abr"
-	"hangout.com/core/storage-service/files/h264"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/ladder"
 	"hangout.com/core/storage-service/files/postprocess"
-	"hangout.com/core/storage-service/files/vp9"
+	"hangout.com/core/storage-service/files/probe"
+	"hangout.com/core/storage-service/files/scheduler"
+	"hangout.com/core/storage-service/files/workspace"
 	"hangout.com/core/storage-service/logger"
 )
 
 type Video struct {
-	Filename string
+	Filename    string
+	ContentType string
+	// Workspace holds the downloaded source and the output folder
+	Workspace *workspace.Workspace
+	// Slots are the CPU slots the encodes share with every other job of the process
+	Slots *scheduler.Slots
+	// Profile is the ladder profile requested by the upload event, if any
+	Profile string
+	// Runner runs ffmpeg and ffprobe
+	Runner command.Runner
+	// Progress receives the progress of the encodes, if set
+	Progress ProgressFunc
 }
 
-func (v *Video) ProcessMedia(ctx context.Context, cfg *koanf.Koanf, log logger.Log) error {
+func (v *Video) ProcessMedia(ctx context.Context, cfg *koanf.Koanf, log logger.Log) (*Output, error) {
 	tr := otel.Tracer("hangout.storage.files")
 	ctx, span := tr.Start(ctx, "ProcessVideo")
 	defer span.End()
 	span.SetAttributes(
 		attribute.String("video.filename", v.Filename),
 	)
-	splittedFilename := strings.Split(v.Filename, ".")
-	inputFile := "/tmp/" + v.Filename
-	outputFolder := "/tmp/" + splittedFilename[0]
-	filename := splittedFilename[0]
-	var err error
-	err = os.Mkdir(outputFolder, 0755)
+	inputFile := v.Workspace.Source()
+	outputFolder := v.Workspace.Output()
+	filename := v.Workspace.Name()
+	profile, err := ladder.Select(cfg, v.ContentType, v.Profile)
 	if err != nil {
-		log.Error(ctx, "could not create base output folder", "err", err.Error())
+		log.Error(ctx, "could not select ladder profile", "error", err.Error())
+		return nil, exceptions.NewPermanentStageError(exceptions.StageProcess, "ladder profile", err)
+	}
+	span.SetAttributes(attribute.String("ladder.profile", profile.Name))
+	probeCtx, cancel := stageContext(ctx, cfg, "probe")
+	metadata, err := probe.Probe(probeCtx, v.Runner, inputFile)
+	cancel()
+	if err != nil {
+		log.Error(ctx, "could not probe video", "error", err.Error())
+		return nil, err
+	}
+	log.Info(ctx, "probed video", "width", metadata.Width, "height", metadata.Height, "rotation", metadata.Rotation, "fps", metadata.FrameRate, "codec", metadata.VideoCodec, "audio", metadata.HasAudio)
+	rungs := ladder.For(metadata, profile)
+	output := &Output{DurationSeconds: metadata.DurationSeconds}
+	var files []string
+	output.Renditions, output.Manifests, files, err = processLadder(ctx, cfg, v.Runner, v.Slots, inputFile, outputFolder, filename, profile, rungs, metadata.HasAudio, newProgressTracker(cfg, metadata.DurationSeconds, v.Progress), log)
+	if len(output.Manifests) > 0 {
+		output.Manifest = output.Manifests[0].Name
+	}
+	if err == nil {
+		// the previews decode the video again, so they wait for a CPU slot like the encodes
+		previews := stageTask(cfg, "preview", "preview", nil, func(ctx context.Context) error {
+			var err error
+			output.Previews, err = createPreviews(ctx, v.Runner, inputFile, outputFolder, metadata, loadPreviewSettings(cfg), log)
+			return err
+		})
+		err = scheduler.Run(ctx, []scheduler.Task{previews}, 1, v.Slots)
 	}
-	err = processH264(ctx, inputFile, outputFolder, filename, log)
 	if err != nil {
 		log.Error(ctx, "error in video processing pipeline", "error", err.Error())
 	}
-	postprocess.CleanUp(ctx, "h264", v.Filename, log)
+	postprocess.CleanUp(ctx, inputFile, files, log)
 	if err != nil {
-		return err
+		return nil, err
 	} else {
-		return nil
+		return output, nil
 	}
 }
 
-func processH264(ctx context.Context, inputFilePath string, outputFolder string, filename string, log logger.Log) error {
+// processLadder encodes the rungs, and an audio track for every audio codec the encoders of the profile
+// ask for, in parallel, and packages them once all of them are done into DASH playlists with an adaptation set per codec. Depending on the profile
+// every codec goes into the main playlist or into a sibling playlist of its own.
+// The encodes report their progress to progress. It returns the renditions, the playlists, the main one first, and the intermediate files it wrote.
+func processLadder(ctx context.Context, cfg *koanf.Koanf, runner command.Runner, slots *scheduler.Slots, inputFilePath string, outputFolder string, filename string, profile ladder.Profile, rungs []ladder.Rung, hasAudio bool, progress *progressTracker, log logger.Log) ([]Rendition, []Manifest, []string, error) {
 	tr := otel.Tracer("hangout.storage.files")
-	ctx, span := tr.Start(ctx, "ProcessH264")
+	ctx, span := tr.Start(ctx, "ProcessLadder")
 	defer span.End()
 	span.SetAttributes(
 		attribute.String("video.filename", filename),
-		attribute.String("encoder", "h264"),
+		attribute.String("ladder.profile", profile.Name),
+		attribute.StringSlice("ladder.codecs", profile.Codecs()),
+		attribute.String("ladder.execution", profile.Execution),
 	)
-	log = log.With("encoder", "h264")
+	log = log.With("profile", profile.Name)
 	log.Info(ctx, "pipeline checkpoint", "status", "starting processing")
 	outputFilePath := outputFolder + "/" + filename
 	log.Debug(ctx, "Check", "Input file path", inputFilePath)
 	log.Debug(ctx, "Check", "Output file path", outputFilePath)
-	h264.ProcessSDRResolutions(ctx, inputFilePath, outputFilePath, log)
-	h264.ProcessAudio(ctx, inputFilePath, outputFilePath, log)
-	abr.CreatePlaylist(ctx, outputFilePath, "h264", log)
+	encoders, err := encodersOf(profile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// every rendition and audio track is encoded on its own, packaging waits for all of them
+	tasks, encodes, audios := ladderEncodes(cfg, runner, inputFilePath, outputFilePath, profile, encoders, rungs, hasAudio, progress, log)
+	var renditions []Rendition
+	next := 0
+	for _, encoder := range encoders {
+		for _, rung := range rungsOf(rungs, encoder) {
+			renditions = append(renditions, Rendition{Name: rung.Name, Codec: rung.Codec, Type: "video", Width: rung.Width, Height: rung.Height})
+		}
+		// the audio tracks follow the renditions of the first encoder asking for them
+		if next < len(audios) && encoder.Audio() == audios[next] {
+			renditions = append(renditions, Rendition{Name: "audio", Codec: audios[next].Name, Type: "audio"})
+			next++
+		}
+	}
+	type playlist struct {
+		base   string
+		tracks []abr.Track
+	}
+	var manifests []Manifest
+	var playlists []playlist
+	for _, group := range manifestGroups(profile, encoders) {
+		base := filename
+		if len(playlists) > 0 {
+			base = filename + "_" + group[0].Name()
+		}
+		var codecs []string
+		var tracks []abr.Track
+		var groupAudios []AudioCodec
+		for _, encoder := range group {
+			codecs = append(codecs, encoder.Name())
+			for _, rung := range rungsOf(rungs, encoder) {
+				track := abr.Track{File: renditionFile(outputFilePath, rung, encoder), Id: rung.Id()}
+				if hasAudio {
+					track.AudioId = "audio_" + encoder.Audio().Name
+				}
+				tracks = append(tracks, track)
+			}
+			if audio := encoder.Audio(); hasAudio && !slices.Contains(groupAudios, audio) {
+				groupAudios = append(groupAudios, audio)
+				tracks = append(tracks, abr.Track{File: audioFile(outputFilePath, audio), Id: "audio_" + audio.Name, Audio: true})
+			}
+		}
+		for _, format := range profile.Formats {
+			manifests = append(manifests, Manifest{Name: base + abr.Extension(format), Format: format, Codecs: codecs})
+		}
+		playlists = append(playlists, playlist{base: base, tracks: tracks})
+	}
+	var files []string
+	for _, rung := range rungs {
+		encoder, _ := EncoderFor(rung.Codec)
+		files = append(files, renditionFile(outputFilePath, rung, encoder))
+	}
+	for _, audio := range audios {
+		files = append(files, audioFile(outputFilePath, audio))
+	}
+	packaging := stageTask(cfg, "package", "package", encodes, func(ctx context.Context) error {
+		for _, playlist := range playlists {
+			if err := abr.CreatePlaylist(ctx, outputFolder+"/"+playlist.base, playlist.tracks, profile.Formats, log); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// packaging only reads and writes files
+	packaging.Slots = 0
+	progress.track(encodes)
+	log.Info(ctx, "pipeline checkpoint", "status", "starting encodes", "execution", profile.Execution, "renditions", len(rungs), "audio", len(audios), "concurrency", jobConcurrency(cfg))
+	err = scheduler.Run(ctx, append(tasks, packaging), jobConcurrency(cfg), slots)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, files, err
+	}
 	log.Info(ctx, "pipeline checkpoint", "file", inputFilePath, "status", "finished processing")
-	return nil
+	return renditions, manifests, files, nil
 }
 
-func processVp9(ctx context.Context, inputFilePath string, outputFolder string, filename string, log logger.Log) error {
-	tr := otel.Tracer("hangout.storage.files")
-	ctx, span := tr.Start(ctx, "ProcessVp9")
-	defer span.End()
-	span.SetAttributes(
-		attribute.String("video.filename", filename),
-		attribute.String("encoder", "vp9"),
-	)
-	log = log.With("encoder", "vp9")
-	log.Info(ctx, "pipeline checkpoint", "status", "starting processing")
-	outputFilePath := outputFolder + "/" + filename
-	log.Debug(ctx, "Input")
-	log.Debug(ctx, "Output", "output file path", outputFilePath)
-	vp9.ProcessSDRResolutions(ctx, inputFilePath, outputFilePath, log)
-	vp9.ProcessAudio(ctx, inputFilePath, outputFilePath, log)
-	abr.CreatePlaylist(ctx, outputFilePath, "vp9", log)
-	log.Info(ctx, "pipeline checkpoint", "status", "finished processing")
-	return nil
+// ladderEncodes are the tasks that encode the rungs of a profile and an audio track for every audio codec its encoders
+// ask for, their names and the audio codecs. In single decode mode the rungs of encoders with a single pass and the audio tracks share one task.
+func ladderEncodes(cfg *koanf.Koanf, runner command.Runner, inputFilePath string, outputFilePath string, profile ladder.Profile, encoders []Encoder, rungs []ladder.Rung, hasAudio bool, progress *progressTracker, log logger.Log) ([]scheduler.Task, []string, []AudioCodec) {
+	var audios []AudioCodec
+	for _, encoder := range encoders {
+		// a source without audio has nothing to encode
+		if audio := encoder.Audio(); hasAudio && !slices.Contains(audios, audio) {
+			audios = append(audios, audio)
+		}
+	}
+	var tasks []scheduler.Task
+	var encodes []string
+	separate, separateAudios := rungs, audios
+	if profile.Execution == ladder.ExecutionSingleDecode {
+		var shared []ladder.Rung
+		shared, separate = singleDecodeRungs(rungs)
+		sharedAudios := audios
+		separateAudios = nil
+		if len(shared)+len(sharedAudios) > 0 {
+			single := stageTask(cfg, "transcode", "transcode_single_decode", nil, func(ctx context.Context) error {
+				return transcodeSingleDecode(ctx, runner, inputFilePath, outputFilePath, shared, sharedAudios, profile.AudioBitrate(), progress, "transcode_single_decode", log)
+			})
+			// one process runs an encoder per output
+			single.Slots = len(shared) + len(sharedAudios)
+			tasks = append(tasks, single)
+			encodes = append(encodes, single.Name)
+		}
+	}
+	for _, rung := range separate {
+		tasks = append(tasks, stageTask(cfg, "transcode", "transcode_"+rung.Id(), nil, func(ctx context.Context) error {
+			return transcodeRendition(ctx, runner, inputFilePath, outputFilePath, rung, progress, log)
+		}))
+		encodes = append(encodes, "transcode_"+rung.Id())
+	}
+	for _, audio := range separateAudios {
+		tasks = append(tasks, stageTask(cfg, "audio", "audio_"+audio.Name, nil, func(ctx context.Context) error {
+			return encodeAudio(ctx, runner, inputFilePath, audioFile(outputFilePath, audio), audio, profile.AudioBitrate(), progress, "audio_"+audio.Name, log)
+		}))
+		encodes = append(encodes, "audio_"+audio.Name)
+	}
+	return tasks, encodes, audios
+}
+
+// rungsOf returns the rungs encoded by the encoder
+func rungsOf(rungs []ladder.Rung, encoder Encoder) []ladder.Rung {
+	var matching []ladder.Rung
+	for _, rung := range rungs {
+		if rung.Codec == encoder.Name() {
+			matching = append(matching, rung)
+		}
+	}
+	return matching
+}
+
+// manifestGroups splits the encoders by the manifest they are packaged into, the main manifest first.
+// With one manifest per codec the fallback codecs share the main manifest, so that it plays everywhere.
+func manifestGroups(profile ladder.Profile, encoders []Encoder) [][]Encoder {
+	if profile.Manifests != ladder.ManifestsPerCodec {
+		return [][]Encoder{encoders}
+	}
+	var fallback []Encoder
+	var groups [][]Encoder
+	for _, encoder := range encoders {
+		if encoder.Packaging().Fallback {
+			fallback = append(fallback, encoder)
+		} else {
+			groups = append(groups, []Encoder{encoder})
+		}
+	}
+	if len(fallback) > 0 {
+		groups = append([][]Encoder{fallback}, groups...)
+	}
+	return groups
+}
+
+// encodersOf returns the encoders of the codecs of a profile. Fallback codecs come first so that
+// players which pick the first adaptation set they can play start with them.
+func encodersOf(profile ladder.Profile) ([]Encoder, error) {
+	var encoders []Encoder
+	for _, codec := range profile.Codecs() {
+		encoder, err := EncoderFor(codec)
+		if err != nil {
+			return nil, err
+		}
+		encoders = append(encoders, encoder)
+	}
+	slices.SortStableFunc(encoders, func(a, b Encoder) int {
+		switch {
+		case a.Packaging().Fallback == b.Packaging().Fallback:
+			return 0
+		case a.Packaging().Fallback:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return encoders, nil
 }
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/ladder"
+)
+
+// Encoder turns the source video into renditions of a single codec.
+// Implementations register themselves by name with Register, ladder profiles refer to them by that name.
+type Encoder interface {
+	// Name is how ladder profiles refer to the codec
+	Name() string
+	// Passes is how often every rendition is encoded. All passes but the last one only collect statistics.
+	Passes() int
+	// VideoArgs returns the ffmpeg encoder arguments of a rendition
+	VideoArgs(rung ladder.Rung) []string
+	// Container is the file extension of the encoded renditions
+	Container() string
+	// Audio is the audio codec that accompanies the renditions in the manifest
+	Audio() AudioCodec
+	// Packaging describes how the renditions are placed into manifests
+	Packaging() PackagingHints
+}
+
+// AudioCodec is the codec of an audio track
+type AudioCodec struct {
+	// Name is the codec as it is reported in the result, for example aac
+	Name string
+	// Encoder is the ffmpeg encoder of the codec, for example libopus
+	Encoder string
+}
+
+// PackagingHints tell the packager how to treat the renditions of an encoder
+type PackagingHints struct {
+	// Fallback marks codecs every client can play. Their adaptation sets are listed first in the manifest.
+	Fallback bool
+}
+
+// AverageBitrateArgs encode a rendition with a target bitrate at that average bitrate, otherwise with constant quality,
+// capped at the maxrate and bufsize of the rung
+func AverageBitrateArgs(rung ladder.Rung) []string {
+	var args []string
+	if rung.Bitrate != "" {
+		args = append(args, "-b:v", rung.Bitrate)
+	} else {
+		args = append(args, "-crf", strconv.Itoa(rung.CRF))
+	}
+	return append(args, capArgs(rung)...)
+}
+
+// ConstrainedQualityArgs encode a rendition with a target bitrate in constrained quality mode, otherwise in constant
+// quality mode, capped at the maxrate and bufsize of the rung
+func ConstrainedQualityArgs(rung ladder.Rung) []string {
+	var args []string
+	if rung.CRF > 0 {
+		args = append(args, "-crf", strconv.Itoa(rung.CRF))
+	}
+	if rung.Bitrate != "" {
+		args = append(args, "-b:v", rung.Bitrate)
+	} else {
+		args = append(args, "-b:v", "0")
+	}
+	return append(args, capArgs(rung)...)
+}
+
+// KeyframeArgs fix the keyframe interval at the GOP of the rung, so that every segment starts on a keyframe
+func KeyframeArgs(rung ladder.Rung) []string {
+	gop := strconv.Itoa(rung.GOP)
+	return []string{"-g", gop, "-keyint_min", gop}
+}
+
+func capArgs(rung ladder.Rung) []string {
+	var args []string
+	if rung.Maxrate != "" {
+		args = append(args, "-maxrate", rung.Maxrate)
+	}
+	if rung.Bufsize != "" {
+		args = append(args, "-bufsize", rung.Bufsize)
+	}
+	return args
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{}
+)
+
+// Register makes an encoder available to ladder profiles. It panics if an encoder with the same name is already registered.
+func Register(encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if _, ok := encoders[encoder.Name()]; ok {
+		panic("pipeline: encoder " + encoder.Name() + " registered twice")
+	}
+	encoders[encoder.Name()] = encoder
+}
+
+// EncoderFor looks up the encoder of a codec named in a ladder profile. A profile with an unknown codec can never succeed.
+func EncoderFor(name string) (Encoder, error) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	encoder, ok := encoders[name]
+	if !ok {
+		return nil, exceptions.NewPermanentStageError(exceptions.StageTranscodeRendition, name, fmt.Errorf("unsupported codec %q in ladder profile, known codecs are %v", name, registered()))
+	}
+	return encoder, nil
+}
+
+func registered() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// renditionFile is the file a rendition of the encoder is written to
+func renditionFile(outputFilePath string, rung ladder.Rung, encoder Encoder) string {
+	return outputFilePath + "_" + rung.Id() + "." + encoder.Container()
+}
+
+// audioFile is the file the audio track of the codec is written to
+func audioFile(outputFilePath string, audio AudioCodec) string {
+	return outputFilePath + "_audio_" + audio.Name + ".mp4"
+}
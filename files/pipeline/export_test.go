@@ -0,0 +1,26 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/probe"
+	"hangout.com/core/storage-service/logger"
+)
+
+// EncodeLadder runs the encodes processLadder schedules for a profile one after another, without packaging them
+func EncodeLadder(ctx context.Context, cfg *koanf.Koanf, runner command.Runner, inputFilePath string, outputFilePath string, profile ladder.Profile, metadata *probe.Metadata, log logger.Log) error {
+	encoders, err := encodersOf(profile)
+	if err != nil {
+		return err
+	}
+	tasks, _, _ := ladderEncodes(cfg, runner, inputFilePath, outputFilePath, profile, encoders, ladder.For(metadata, profile), metadata.HasAudio, nil, log)
+	for _, task := range tasks {
+		if err := task.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
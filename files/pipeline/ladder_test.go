@@ -0,0 +1,78 @@
+package pipeline_test
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	_ "hangout.com/core/storage-service/files/av1"
+	"hangout.com/core/storage-service/files/command/commandtest"
+	_ "hangout.com/core/storage-service/files/h264"
+	_ "hangout.com/core/storage-service/files/hevc"
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/pipeline"
+	"hangout.com/core/storage-service/files/probe"
+	_ "hangout.com/core/storage-service/files/vp9"
+	"hangout.com/core/storage-service/logger"
+)
+
+// sources are the probed videos every profile is encoded from
+var sources = []struct {
+	name     string
+	metadata probe.Metadata
+}{
+	{
+		name: "landscape_1080p",
+		metadata: probe.Metadata{Width: 1920, Height: 1080, CodedWidth: 1920, CodedHeight: 1080, FrameRate: 30, DurationSeconds: 60,
+			VideoCodec: "h264", AudioCodec: "aac", HasVideo: true, HasAudio: true, AudioSampleRate: 48000, AudioChannels: 2},
+	},
+	{
+		name: "portrait_720p_silent",
+		metadata: probe.Metadata{Width: 720, Height: 1280, CodedWidth: 1280, CodedHeight: 720, Rotation: 90, FrameRate: 29.97, DurationSeconds: 15,
+			VideoCodec: "hevc", HasVideo: true},
+	},
+}
+
+// TestLadderCommands locks down the ffmpeg commands of every ladder profile of the default configuration and of the built in ladder.
+// Run with -update to rewrite testdata/ladders after an intended change.
+func TestLadderCommands(t *testing.T) {
+	cfg := koanf.New(".")
+	if err := cfg.Load(file.Provider("../../resources/application-default.yaml"), yaml.Parser()); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Set("log.level", "error")
+	log := logger.NewLogger(cfg)
+	profiles := map[string]ladder.Profile{}
+	for _, name := range cfg.MapKeys("process.ladders") {
+		profile, err := ladder.Load(cfg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profiles[name] = profile
+	}
+	// without any configuration the default profile is the built in ladder
+	builtin, err := ladder.Load(koanf.New("."), ladder.DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles["builtin"] = builtin
+	names := slices.Sorted(maps.Keys(profiles))
+	for _, name := range names {
+		profile := profiles[name]
+		for _, source := range sources {
+			t.Run(name+"/"+source.name, func(t *testing.T) {
+				recorder := &commandtest.Recorder{}
+				err := pipeline.EncodeLadder(context.Background(), cfg, recorder, "/work/source.mp4", "/work/output/source", profile, &source.metadata, log)
+				if err != nil {
+					t.Fatal(err)
+				}
+				commandtest.Golden(t, filepath.Join("testdata", "ladders", name+"_"+source.name+".golden"), commandtest.Format(recorder.Commands()))
+			})
+		}
+	}
+}
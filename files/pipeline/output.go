@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/logger"
+)
+
+// Media is a downloaded file that one of the pipelines processes into the output folder named after it
+type Media interface {
+	ProcessMedia(ctx context.Context, cfg *koanf.Koanf, log logger.Log) (*Output, error)
+}
+
+// Rendition is a single encoded stream that is part of the final output
+type Rendition struct {
+	Name   string `json:"name"`
+	Codec  string `json:"codec"`
+	Type   string `json:"type"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// Manifest is a playlist file inside the output folder and the video codecs it offers
+type Manifest struct {
+	Name   string   `json:"name"`
+	Format string   `json:"format"`
+	Codecs []string `json:"codecs"`
+}
+
+// StillImage is a still image inside the output folder
+type StillImage struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Storyboard is a set of sprite sheets for seek previews and the WebVTT track that maps playback time to their tiles
+type Storyboard struct {
+	Track           string   `json:"track"`
+	Sprites         []string `json:"sprites"`
+	IntervalSeconds float64  `json:"intervalSeconds"`
+	TileWidth       int      `json:"tileWidth"`
+	TileHeight      int      `json:"tileHeight"`
+	Columns         int      `json:"columns"`
+	Rows            int      `json:"rows"`
+}
+
+// ProgressiveFile is an audio rendition written as a plain file for players that download instead of stream
+type ProgressiveFile struct {
+	Name    string `json:"name"`
+	Codec   string `json:"codec"`
+	Bitrate string `json:"bitrate"`
+}
+
+// Previews are the still images shown for a video before it plays
+type Previews struct {
+	Poster     StillImage
+	Thumbnails []StillImage
+	Storyboard *Storyboard
+}
+
+// Output describes what a pipeline produced for a single file
+type Output struct {
+	// Manifest is the name of the main playlist file inside the output folder
+	Manifest string
+	// Manifests lists every playlist, the main one first. Profiles with one manifest per codec have more than one.
+	Manifests       []Manifest
+	Renditions      []Rendition
+	DurationSeconds float64
+	Previews        *Previews
+	// Variants are the sizes and formats an image is served in
+	Variants []StillImage
+	// Blurhash is the placeholder shown while an image loads
+	Blurhash string
+	// Waveform is the name of the peaks file of an audio file
+	Waveform    string
+	Progressive []ProgressiveFile
+}
@@ -0,0 +1,287 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/probe"
+	"hangout.com/core/storage-service/logger"
+)
+
+// previewSettings are the sizes and formats of the still images generated for a video, from process.previews
+type previewSettings struct {
+	posterWidth      int
+	thumbnailWidths  []int
+	thumbnailFormats []string
+	spriteInterval   time.Duration
+	tileWidth        int
+	columns          int
+	rows             int
+}
+
+// defaultPreviewSettings are used for every setting process.previews leaves out
+var defaultPreviewSettings = previewSettings{
+	posterWidth:      1280,
+	thumbnailWidths:  []int{160, 320, 640},
+	thumbnailFormats: []string{"webp", "jpg"},
+	spriteInterval:   2 * time.Second,
+	tileWidth:        160,
+	columns:          10,
+	rows:             10,
+}
+
+// posterCandidates are the points of the video, as a share of its duration, a poster frame is picked from
+var posterCandidates = []float64{0.1, 0.25, 0.4, 0.55, 0.7}
+
+// posterBatch is how many consecutive frames the ffmpeg thumbnail filter compares at every candidate point
+const posterBatch = 30
+
+func loadPreviewSettings(cfg *koanf.Koanf) previewSettings {
+	settings := defaultPreviewSettings
+	if width := cfg.Int("process.previews.poster-width"); width > 0 {
+		settings.posterWidth = width
+	}
+	if widths := cfg.Ints("process.previews.thumbnail-widths"); len(widths) > 0 {
+		settings.thumbnailWidths = widths
+	}
+	if formats := cfg.Strings("process.previews.thumbnail-formats"); len(formats) > 0 {
+		settings.thumbnailFormats = formats
+	}
+	if interval := cfg.Duration("process.previews.sprite-interval"); interval > 0 {
+		settings.spriteInterval = interval
+	}
+	if width := cfg.Int("process.previews.sprite-tile-width"); width > 0 {
+		settings.tileWidth = width
+	}
+	if columns := cfg.Int("process.previews.sprite-columns"); columns > 0 {
+		settings.columns = columns
+	}
+	if rows := cfg.Int("process.previews.sprite-rows"); rows > 0 {
+		settings.rows = rows
+	}
+	return settings
+}
+
+// createPreviews writes the poster, the thumbnails and the seek preview sprite sheets of a video into the output folder
+func createPreviews(ctx context.Context, runner command.Runner, inputFilePath string, outputFolder string, metadata *probe.Metadata, settings previewSettings, log logger.Log) (*Previews, error) {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "CreatePreviews")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("video.filename", inputFilePath),
+		attribute.Float64("video.duration", metadata.DurationSeconds),
+	)
+	log.Info(ctx, "pipeline checkpoint", "status", "starting previews")
+	previews := &Previews{}
+	var err error
+	previews.Poster, err = createPoster(ctx, runner, inputFilePath, outputFolder, metadata, settings.posterWidth, log)
+	if err != nil {
+		return nil, err
+	}
+	posterFile := filepath.Join(outputFolder, previews.Poster.Name)
+	for _, width := range settings.thumbnailWidths {
+		// thumbnails are scaled down from the poster, never up
+		if width > previews.Poster.Width {
+			continue
+		}
+		for _, format := range settings.thumbnailFormats {
+			thumbnail, err := createThumbnail(ctx, runner, posterFile, outputFolder, metadata, width, format)
+			if err != nil {
+				log.Error(ctx, "error in creating thumbnail", "width", width, "format", format, "error", err.Error())
+				return nil, err
+			}
+			previews.Thumbnails = append(previews.Thumbnails, thumbnail)
+		}
+	}
+	previews.Storyboard, err = createStoryboard(ctx, runner, inputFilePath, outputFolder, metadata, settings)
+	if err != nil {
+		log.Error(ctx, "error in creating storyboard", "error", err.Error())
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.Int("previews.thumbnails", len(previews.Thumbnails)),
+		attribute.Int("previews.sprites", len(previews.Storyboard.Sprites)),
+	)
+	log.Info(ctx, "pipeline checkpoint", "status", "finished previews", "thumbnails", len(previews.Thumbnails), "sprites", len(previews.Storyboard.Sprites))
+	return previews, nil
+}
+
+// createPoster extracts a frame at every candidate point, letting the ffmpeg thumbnail filter pick
+// the most representative of a short batch of frames there, and keeps the one with the best score
+func createPoster(ctx context.Context, runner command.Runner, inputFilePath string, outputFolder string, metadata *probe.Metadata, maxWidth int, log logger.Log) (StillImage, error) {
+	width := min(maxWidth, metadata.Width)
+	poster := StillImage{Name: "poster.jpg", Format: "jpg", Width: width, Height: scaledHeight(metadata.Width, metadata.Height, width)}
+	points := posterCandidates
+	if metadata.DurationSeconds <= 0 {
+		points = []float64{0}
+	}
+	best, bestScore := "", -1.0
+	for i, point := range points {
+		candidate := filepath.Join(outputFolder, "poster_candidate_"+strconv.Itoa(i)+".jpg")
+		defer os.Remove(candidate)
+		offset := strconv.FormatFloat(point*metadata.DurationSeconds, 'f', 3, 64)
+		args := []string{"-y", "-ss", offset, "-i", inputFilePath, "-an",
+			"-vf", "thumbnail=" + strconv.Itoa(posterBatch) + "," + scaleFilter(poster.Width, poster.Height),
+			"-frames:v", "1", "-q:v", "2", candidate}
+		_, err := runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: args, Stage: exceptions.StagePreview, Detail: "poster at " + offset + "s"})
+		if err != nil {
+			log.Error(ctx, "error in extracting poster candidate", "offset", offset, "error", err.Error())
+			return poster, err
+		}
+		score, err := frameScore(candidate)
+		if err != nil {
+			// ffmpeg writes nothing when the seek point lies past the last frame
+			log.Debug(ctx, "skipping poster candidate", "offset", offset, "error", err.Error())
+			continue
+		}
+		log.Debug(ctx, "poster candidate", "offset", offset, "score", score)
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	if best == "" {
+		return poster, exceptions.NewStageError(exceptions.StagePreview, "poster", fmt.Errorf("no frame could be extracted"))
+	}
+	if err := os.Rename(best, filepath.Join(outputFolder, poster.Name)); err != nil {
+		return poster, exceptions.NewStageError(exceptions.StagePreview, "poster", err)
+	}
+	return poster, nil
+}
+
+// frameScore rates a candidate poster by the contrast of its luma. Frames that are almost black or white,
+// like fades and title cards, get a fraction of their score so that any frame showing the scene beats them.
+func frameScore(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	var sum, sumOfSquares, samples float64
+	// every fourth pixel in both directions is plenty for a brightness estimate
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 4 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 4 {
+			luma := float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			sum += luma
+			sumOfSquares += luma * luma
+			samples++
+		}
+	}
+	if samples == 0 {
+		return 0, fmt.Errorf("empty frame")
+	}
+	mean := sum / samples
+	contrast := math.Sqrt(math.Max(0, sumOfSquares/samples-mean*mean))
+	if mean < 40 || mean > 215 {
+		return contrast / 10, nil
+	}
+	return contrast, nil
+}
+
+func createThumbnail(ctx context.Context, runner command.Runner, posterFile string, outputFolder string, metadata *probe.Metadata, width int, format string) (StillImage, error) {
+	thumbnail := StillImage{Name: "thumbnail_" + strconv.Itoa(width) + "." + format, Format: format, Width: width, Height: scaledHeight(metadata.Width, metadata.Height, width)}
+	codecArgs, err := stillImageArgs(format)
+	if err != nil {
+		return thumbnail, exceptions.NewPermanentStageError(exceptions.StagePreview, "thumbnail", err)
+	}
+	args := append([]string{"-y", "-i", posterFile, "-vf", scaleFilter(thumbnail.Width, thumbnail.Height)}, codecArgs...)
+	_, err = runner.Run(ctx, command.Cmd{Name: "ffmpeg", Args: append(args, filepath.Join(outputFolder, thumbnail.Name)), Stage: exceptions.StagePreview, Detail: thumbnail.Name})
+	return thumbnail, err
+}
+
+// createStoryboard samples a frame every sprite interval into tiles of sprite sheets and writes
+// a WebVTT track pointing every interval of the video at its tile
+func createStoryboard(ctx context.Context, runner command.Runner, inputFilePath string, outputFolder string, metadata *probe.Metadata, settings previewSettings) (*Storyboard, error) {
+	interval := settings.spriteInterval.Seconds()
+	storyboard := &Storyboard{
+		Track:           "storyboard.vtt",
+		IntervalSeconds: interval,
+		TileWidth:       settings.tileWidth,
+		TileHeight:      scaledHeight(metadata.Width, metadata.Height, settings.tileWidth),
+		Columns:         settings.columns,
+		Rows:            settings.rows,
+	}
+	tiles := max(1, int(math.Ceil(metadata.DurationSeconds/interval)))
+	perSheet := settings.columns * settings.rows
+	for sheet := 1; sheet <= (tiles+perSheet-1)/perSheet; sheet++ {
+		storyboard.Sprites = append(storyboard.Sprites, "sprite_"+strconv.Itoa(sheet)+".jpg")
+	}
+	filter := "fps=1/" + strconv.FormatFloat(interval, 'f', -1, 64) + "," +
+		scaleFilter(storyboard.TileWidth, storyboard.TileHeight) + "," +
+		"tile=" + strconv.Itoa(settings.columns) + "x" + strconv.Itoa(settings.rows)
+	_, err := runner.Run(ctx, command.Cmd{
+		Name:   "ffmpeg",
+		Args:   []string{"-y", "-i", inputFilePath, "-an", "-vf", filter, "-q:v", "4", filepath.Join(outputFolder, "sprite_%d.jpg")},
+		Stage:  exceptions.StagePreview,
+		Detail: "sprites",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for tile := 0; tile < tiles; tile++ {
+		start := float64(tile) * interval
+		end := start + interval
+		if metadata.DurationSeconds > 0 {
+			end = math.Min(end, metadata.DurationSeconds)
+		}
+		position := tile % perSheet
+		x := position % settings.columns * storyboard.TileWidth
+		y := position / settings.columns * storyboard.TileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTimestamp(start), vttTimestamp(end),
+			storyboard.Sprites[tile/perSheet], x, y, storyboard.TileWidth, storyboard.TileHeight)
+	}
+	if err := os.WriteFile(filepath.Join(outputFolder, storyboard.Track), []byte(b.String()), 0644); err != nil {
+		return nil, exceptions.NewStageError(exceptions.StagePreview, storyboard.Track, err)
+	}
+	return storyboard, nil
+}
+
+// scaledHeight is the even height of a picture of the source size scaled to width
+func scaledHeight(sourceWidth int, sourceHeight int, width int) int {
+	if sourceWidth == 0 {
+		return width
+	}
+	height := int(math.Round(float64(width) * float64(sourceHeight) / float64(sourceWidth)))
+	return max(2, height/2*2)
+}
+
+// stillImageArgs are the ffmpeg codec arguments that write a still image in the format
+func stillImageArgs(format string) ([]string, error) {
+	switch format {
+	case "avif":
+		return []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "30", "-b:v", "0", "-pix_fmt", "yuv420p"}, nil
+	case "webp":
+		return []string{"-c:v", "libwebp", "-quality", "80"}, nil
+	case "jpg", "jpeg":
+		return []string{"-q:v", "3"}, nil
+	}
+	return nil, fmt.Errorf("unsupported image format %q", format)
+}
+
+func scaleFilter(width int, height int) string {
+	return "scale=" + strconv.Itoa(width) + ":" + strconv.Itoa(height)
+}
+
+func vttTimestamp(seconds float64) string {
+	milliseconds := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"hangout.com/core/storage-service/files/command"
+)
+
+// ProgressFunc receives the progress of a whole job in percent while its encodes run
+type ProgressFunc func(ctx context.Context, percent float64)
+
+// defaultProgressInterval is how often progress is reported when process.progress-interval is not set
+const defaultProgressInterval = 10 * time.Second
+
+var (
+	encodeProgress     metric.Float64Gauge
+	encodeProgressOnce sync.Once
+)
+
+func initProgressMetrics() {
+	encodeProgressOnce.Do(func() {
+		meter := otel.GetMeterProvider().Meter("hangout.storage.files")
+		encodeProgress, _ = meter.Float64Gauge("media_encode_progress", metric.WithDescription("Progress of a running encode in percent"), metric.WithUnit("%"))
+	})
+}
+
+// progressTracker combines the ffmpeg progress of the encodes of a job into the progress of the job, every encode weighs the same.
+// Span events, the gauge and the job progress are reported at most once per interval, and once more when an encode ends.
+type progressTracker struct {
+	duration time.Duration
+	interval time.Duration
+	report   ProgressFunc
+
+	mu sync.Mutex
+	// done is the finished fraction of every encode the job progress is made of
+	done     map[string]float64
+	reported map[string]time.Time
+	// lastJob is when the job progress was last handed to report
+	lastJob time.Time
+}
+
+// newProgressTracker tracks the encodes of media that is duration seconds long. report may be nil.
+func newProgressTracker(cfg *koanf.Koanf, duration float64, report ProgressFunc) *progressTracker {
+	initProgressMetrics()
+	interval := cfg.Duration("process.progress-interval")
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	return &progressTracker{
+		duration: time.Duration(duration * float64(time.Second)),
+		interval: interval,
+		report:   report,
+		done:     map[string]float64{},
+		reported: map[string]time.Time{},
+	}
+}
+
+// track sets the names of the encodes the job progress is made of
+func (t *progressTracker) track(encodes []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range encodes {
+		t.done[name] = 0
+	}
+}
+
+// encode returns the progress callback of one pass of the named encode, it adds events to the span in ctx.
+// An encode with more than one pass counts its passes as equal parts.
+func (t *progressTracker) encode(ctx context.Context, name string, pass int, passes int) func(command.Progress) {
+	if t == nil {
+		return nil
+	}
+	span := trace.SpanFromContext(ctx)
+	return func(p command.Progress) {
+		fraction := 0.0
+		if p.End {
+			fraction = 1
+		} else if t.duration > 0 {
+			fraction = math.Min(1, float64(p.OutTime)/float64(t.duration))
+		}
+		fraction = (float64(pass-1) + fraction) / float64(max(1, passes))
+		now := time.Now()
+		t.mu.Lock()
+		if _, tracked := t.done[name]; tracked {
+			t.done[name] = fraction
+		}
+		emit := p.End || now.Sub(t.reported[name]) >= t.interval
+		if emit {
+			t.reported[name] = now
+		}
+		total := 0.0
+		for _, done := range t.done {
+			total += done
+		}
+		job := 100 * total / float64(max(1, len(t.done)))
+		reportJob := emit && (now.Sub(t.lastJob) >= t.interval || job >= 100)
+		if reportJob {
+			t.lastJob = now
+		}
+		t.mu.Unlock()
+		if !emit {
+			return
+		}
+		percent := 100 * fraction
+		span.AddEvent("progress", trace.WithAttributes(
+			attribute.Float64("progress.percent", percent),
+			attribute.Float64("progress.out_time_seconds", p.OutTime.Seconds()),
+			attribute.Float64("progress.fps", p.FPS),
+			attribute.Float64("progress.speed", p.Speed),
+			attribute.Float64("progress.bitrate_kbps", p.Bitrate),
+			attribute.Int("progress.pass", pass),
+		))
+		encodeProgress.Record(ctx, percent, metric.WithAttributes(attribute.String("encode", name)))
+		if reportJob && t.report != nil {
+			t.report(ctx, job)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/logger"
+)
+
+// singleDecodeRungs splits the rungs into those that can share one decode of the source and those that are
+// encoded on their own. Encoders with more than one pass have to read the source once per pass.
+func singleDecodeRungs(rungs []ladder.Rung) (shared []ladder.Rung, separate []ladder.Rung) {
+	for _, rung := range rungs {
+		if encoder, err := EncoderFor(rung.Codec); err == nil && encoder.Passes() == 1 {
+			shared = append(shared, rung)
+		} else {
+			separate = append(separate, rung)
+		}
+	}
+	return shared, separate
+}
+
+// transcodeSingleDecode encodes the rungs and the audio tracks with one ffmpeg process that decodes the source once
+// and splits the frames to a scaler and an encoder per rung. Keyframes are forced at the same timestamps in every
+// output, so the segments of all renditions line up even though their encoders decide independently.
+func transcodeSingleDecode(ctx context.Context, runner command.Runner, inputFilePath string, outputFilePath string, rungs []ladder.Rung, audios []AudioCodec, audioBitrate string, progress *progressTracker, name string, log logger.Log) error {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "TranscodeSingleDecode")
+	defer span.End()
+	var ids []string
+	for _, rung := range rungs {
+		ids = append(ids, rung.Id())
+	}
+	span.SetAttributes(
+		attribute.String("video.filename", inputFilePath),
+		attribute.StringSlice("renditions", ids),
+		attribute.Int("audio", len(audios)),
+	)
+	log = log.With("renditions", ids)
+	log.Info(ctx, "pipeline checkpoint", "status", "starting single decode", "outputs", len(rungs)+len(audios))
+	args := append(slices.Clone(command.ProgressArgs), "-y", "-i", inputFilePath)
+	if len(rungs) > 0 {
+		args = append(args, "-filter_complex", splitGraph(rungs))
+	}
+	for i, rung := range rungs {
+		encoder, err := EncoderFor(rung.Codec)
+		if err != nil {
+			return err
+		}
+		keyframes := "expr:gte(t,n_forced*" + strconv.FormatFloat(rung.Spec.GOP.Seconds(), 'f', -1, 64) + ")"
+		args = append(args, "-map", "[v"+strconv.Itoa(i)+"]")
+		args = append(args, encoder.VideoArgs(rung)...)
+		args = append(args, "-force_key_frames", keyframes, "-an", "-movflags", fragmentedVideo, renditionFile(outputFilePath, rung, encoder))
+	}
+	for _, audio := range audios {
+		args = append(args, "-map", "0:a:0", "-vn")
+		args = append(args, audioOutputArgs(audio, audioBitrate)...)
+		args = append(args, audioFile(outputFilePath, audio))
+	}
+	_, err := runner.Run(ctx, command.Cmd{
+		Name:     "ffmpeg",
+		Args:     args,
+		Stage:    exceptions.StageTranscodeRendition,
+		Detail:   "single decode of " + strings.Join(ids, ", "),
+		Progress: progress.encode(ctx, name, 1, 1),
+	})
+	if err != nil {
+		log.Error(ctx, "error in single decode encoding", "error", err.Error())
+		return err
+	}
+	log.Info(ctx, "pipeline checkpoint", "status", "finished single decode")
+	return nil
+}
+
+// splitGraph is the filter graph that feeds the decoded video to one scaler per rung, its outputs are labelled v0, v1 and so on.
+// ffmpeg applies the rotation of the source before the graph, so the rungs are given in display orientation.
+func splitGraph(rungs []ladder.Rung) string {
+	var b strings.Builder
+	b.WriteString("[0:v]split=" + strconv.Itoa(len(rungs)))
+	for i := range rungs {
+		b.WriteString("[s" + strconv.Itoa(i) + "]")
+	}
+	for i, rung := range rungs {
+		b.WriteString(";[s" + strconv.Itoa(i) + "]scale=" + strconv.Itoa(rung.Width) + "x" + strconv.Itoa(rung.Height) + "[v" + strconv.Itoa(i) + "]")
+	}
+	return b.String()
+}
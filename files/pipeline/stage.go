@@ -0,0 +1,40 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/scheduler"
+)
+
+// defaultJobConcurrency is how many tasks of a job run at the same time when process.job-concurrency is not set
+const defaultJobConcurrency = 4
+
+// stageContext bounds a pipeline stage by its limit in process.stage-timeouts.
+// A stage without a configured limit only ends with the job.
+func stageContext(ctx context.Context, cfg *koanf.Koanf, stage string) (context.Context, context.CancelFunc) {
+	limit := cfg.Duration("process.stage-timeouts." + stage)
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, limit, &exceptions.TimeoutError{Scope: stage + " stage", Limit: limit})
+}
+
+// stageTask is a task holding a CPU slot that is bounded by the limit of its stage in process.stage-timeouts. Every task of a stage
+// gets the whole limit, as the tasks of a stage run side by side.
+func stageTask(cfg *koanf.Koanf, stage string, name string, after []string, run func(ctx context.Context) error) scheduler.Task {
+	return scheduler.Task{Name: name, After: after, Slots: 1, Run: func(ctx context.Context) error {
+		stageCtx, cancel := stageContext(ctx, cfg, stage)
+		defer cancel()
+		return run(stageCtx)
+	}}
+}
+
+// jobConcurrency is how many tasks of a single job may run at the same time, from process.job-concurrency
+func jobConcurrency(cfg *koanf.Koanf) int {
+	if concurrency := cfg.Int("process.job-concurrency"); concurrency > 0 {
+		return concurrency
+	}
+	return defaultJobConcurrency
+}
@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/abr"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/logger"
+)
+
+// fragmentedVideo are the movflags of encoded renditions, a fragment per keyframe,
+// so that the packager can cut segments at every fragment
+const fragmentedVideo = "+frag_keyframe+empty_moov+default_base_moof"
+
+func transcodeRendition(ctx context.Context, runner command.Runner, inputFilePath string, outputFilePath string, rung ladder.Rung, progress *progressTracker, log logger.Log) error {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "TranscodeRendition")
+	defer span.End()
+	resolution := strconv.Itoa(rung.Width) + "x" + strconv.Itoa(rung.Height)
+	span.SetAttributes(
+		attribute.String("video.filename", inputFilePath),
+		attribute.String("encoder", rung.Codec),
+		attribute.String("media-type", "video-sdr"),
+		attribute.String("rendition", rung.Name),
+		attribute.String("resolution", resolution),
+		attribute.Int("gop", rung.GOP),
+	)
+	log = log.With("encoder", rung.Codec, "resolution", resolution)
+	log.Debug(ctx, "pipeline checkpoint", "status", "starting processing")
+	encoder, err := EncoderFor(rung.Codec)
+	if err != nil {
+		return err
+	}
+	outputFile := renditionFile(outputFilePath, rung, encoder)
+	passLog := outputFile + ".passlog"
+	passes := encoder.Passes()
+	for pass := 1; pass <= passes; pass++ {
+		// ffmpeg applies the rotation of the source before scaling, so the rung is given in display orientation
+		args := append(slices.Clone(command.ProgressArgs), "-y", "-i", inputFilePath, "-vf", "scale="+resolution)
+		args = append(args, encoder.VideoArgs(rung)...)
+		args = append(args, "-an")
+		detail := rung.Codec + " " + rung.Name
+		target := outputFile
+		if passes > 1 {
+			args = append(args, "-pass", strconv.Itoa(pass), "-passlogfile", passLog)
+			detail += " pass " + strconv.Itoa(pass)
+			if pass < passes {
+				// the first passes only write statistics
+				args = append(args, "-f", "null")
+				target = os.DevNull
+			}
+		}
+		if target == outputFile {
+			args = append(args, "-movflags", fragmentedVideo)
+		}
+		_, err = runner.Run(ctx, command.Cmd{
+			Name:     "ffmpeg",
+			Args:     append(args, target),
+			Stage:    exceptions.StageTranscodeRendition,
+			Detail:   detail,
+			Progress: progress.encode(ctx, "transcode_"+rung.Id(), pass, passes),
+		})
+		if err != nil {
+			log.Error(ctx, "error in processing video", "pass", pass, "error", err.Error())
+			return err
+		}
+	}
+	if passes > 1 {
+		os.Remove(passLog + "-0.log")
+	}
+	log.Debug(ctx, "pipeline checkpoint", "status", "finished")
+	return nil
+}
+
+// encodeAudio encodes the audio of the source into a fragmented MP4 for packaging, as the track that accompanies
+// renditions of one audio codec or as a rendition of an audio file. An empty bitrate leaves it to the encoder.
+func encodeAudio(ctx context.Context, runner command.Runner, inputFilePath string, outputFile string, audio AudioCodec, bitrate string, progress *progressTracker, name string, log logger.Log) error {
+	tr := otel.Tracer("hangout.storage.files")
+	ctx, span := tr.Start(ctx, "EncodeAudio")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("video.filename", inputFilePath),
+		attribute.String("media-type", "audio"),
+		attribute.String("encoder", audio.Encoder),
+	)
+	log = log.With("encoder", audio.Encoder)
+	log.Info(ctx, "pipeline checkpoint", "status", "starting processing")
+	log.Debug(ctx, "Input", "output file path", outputFile)
+	args := append(slices.Clone(command.ProgressArgs), "-y", "-i", inputFilePath, "-vn")
+	args = append(args, audioOutputArgs(audio, bitrate)...)
+	_, err := runner.Run(ctx, command.Cmd{
+		Name:     "ffmpeg",
+		Args:     append(args, outputFile),
+		Stage:    exceptions.StageAudio,
+		Detail:   strings.TrimSpace(audio.Name + " " + bitrate),
+		Progress: progress.encode(ctx, name, 1, 1),
+	})
+	if err != nil {
+		log.Error(ctx, "error in processing audio", "error", err.Error())
+		return err
+	}
+	log.Debug(ctx, "pipeline checkpoint", "status", "finished")
+	return nil
+}
+
+// audioOutputArgs are the ffmpeg output arguments of an audio track for packaging. Audio has no keyframes
+// to fragment at, fragments are cut at the segment duration instead. An empty bitrate leaves it to the encoder.
+func audioOutputArgs(audio AudioCodec, bitrate string) []string {
+	args := []string{"-c:a", audio.Encoder, "-movflags", "+empty_moov+default_base_moof", "-frag_duration", strconv.Itoa(int(abr.SegmentDuration * 1e6))}
+	if bitrate != "" {
+		args = append(args, "-b:a", bitrate)
+	}
+	return args
+}
@@ -3,16 +3,15 @@ package postprocess
 import (
 	"context"
 	"os"
-	"strings"
 
 	"hangout.com/core/storage-service/logger"
 )
 
-func CleanUp(ctx context.Context, encoding string, filename string, log logger.Log) {
+// CleanUp removes the source file and the intermediate files the pipeline left behind once they have been packaged,
+// so that they are neither uploaded nor take up disk space until the workspace is removed
+func CleanUp(ctx context.Context, sourceFilepath string, intermediates []string, log logger.Log) {
 
-	// delete the original file from temp directory
-	storageDir := "/tmp"
-	sourceFilepath := storageDir + "/" + filename
+	// delete the original file from the workspace
 	err := os.Remove(sourceFilepath)
 	if err != nil {
 		log.Debug(ctx, "could not delete the original file", "error", err, "path", sourceFilepath)
@@ -20,11 +19,7 @@ func CleanUp(ctx context.Context, encoding string, filename string, log logger.L
 	log.Debug(ctx, "removed source file", "path", sourceFilepath)
 
 	// remove transcoded files
-	baseFilename := strings.Split(filename, ".")[0]
-	transcodedVideoFileBaseName := storageDir + "/" + baseFilename + "/" + baseFilename + "_" + encoding + "_"
-	resolutions := []string{"640p", "1280p", "1920p", "audio"}
-	for _, res := range resolutions {
-		finalFileName := transcodedVideoFileBaseName + res + ".mp4"
+	for _, finalFileName := range intermediates {
 		log.Debug(ctx, "removing transcoded video files", "file", finalFileName)
 		err = os.Remove(finalFileName)
 		if err != nil {
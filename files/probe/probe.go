@@ -0,0 +1,222 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+)
+
+// ErrNoVideoStream is returned for files that ffprobe can read but that do not contain any video
+var ErrNoVideoStream = errors.New("no video stream found")
+
+// ErrNoAudioStream is returned by ProbeAudio for files that ffprobe can read but that do not contain any audio
+var ErrNoAudioStream = errors.New("no audio stream found")
+
+// Metadata is what the pipeline needs to know about a source file before transcoding it
+type Metadata struct {
+	// Width and Height are the display dimensions, i.e. after applying Rotation
+	Width  int
+	Height int
+	// CodedWidth and CodedHeight are the dimensions of the frames as they are stored
+	CodedWidth  int
+	CodedHeight int
+	// Rotation is the clockwise rotation in degrees the player has to apply, one of 0, 90, 180 or 270
+	Rotation        int
+	FrameRate       float64
+	DurationSeconds float64
+	VideoCodec      string
+	AudioCodec      string
+	HasVideo        bool
+	HasAudio        bool
+	// AudioSampleRate and AudioChannels describe the first audio stream
+	AudioSampleRate int
+	AudioChannels   int
+}
+
+// ShortEdge returns the smaller of the display dimensions. Renditions are named after it, so a 720p
+// rendition is 1280x720 for landscape and 720x1280 for portrait videos.
+func (m *Metadata) ShortEdge() int {
+	return min(m.Width, m.Height)
+}
+
+// Portrait reports whether the video is taller than it is wide when displayed
+func (m *Metadata) Portrait() bool {
+	return m.Height > m.Width
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	Duration     string            `json:"duration"`
+	SampleRate   string            `json:"sample_rate"`
+	Channels     int               `json:"channels"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+	Disposition map[string]int `json:"disposition"`
+}
+
+// Probe reads the metadata of the media file with ffprobe
+func Probe(ctx context.Context, runner command.Runner, inputFilePath string) (*Metadata, error) {
+	return probe(ctx, runner, inputFilePath, true)
+}
+
+// ProbeAudio reads the metadata of an audio file with ffprobe. Unlike Probe it does not need a video stream,
+// only an audio stream.
+func ProbeAudio(ctx context.Context, runner command.Runner, inputFilePath string) (*Metadata, error) {
+	return probe(ctx, runner, inputFilePath, false)
+}
+
+// probe runs ffprobe and checks that the file has a video stream, or an audio stream if video is false
+func probe(ctx context.Context, runner command.Runner, inputFilePath string, video bool) (*Metadata, error) {
+	tr := otel.Tracer("hangout.storage.files.probe")
+	ctx, span := tr.Start(ctx, "Probe")
+	defer span.End()
+	span.SetAttributes(attribute.String("video.filename", inputFilePath))
+
+	result, err := runner.Run(ctx, command.Cmd{
+		Name:   "ffprobe",
+		Args:   []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams", inputFilePath},
+		Stage:  exceptions.StageProbe,
+		Detail: "ffprobe",
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	metadata, err := parse(result.Stdout)
+	switch {
+	case err != nil:
+	case video && !metadata.HasVideo:
+		err = ErrNoVideoStream
+	case !video && !metadata.HasAudio:
+		err = ErrNoAudioStream
+	}
+	if err != nil {
+		err = exceptions.NewPermanentStageError(exceptions.StageProbe, "ffprobe", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.Int("video.width", metadata.Width),
+		attribute.Int("video.height", metadata.Height),
+		attribute.Int("video.rotation", metadata.Rotation),
+		attribute.Float64("video.fps", metadata.FrameRate),
+		attribute.Float64("video.duration", metadata.DurationSeconds),
+		attribute.String("video.codec", metadata.VideoCodec),
+		attribute.Bool("audio.present", metadata.HasAudio),
+		attribute.String("audio.codec", metadata.AudioCodec),
+	)
+	return metadata, nil
+}
+
+func parse(out []byte) (*Metadata, error) {
+	var probed ffprobeOutput
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return nil, err
+	}
+	metadata := &Metadata{}
+	var video *ffprobeStream
+	for i := range probed.Streams {
+		stream := &probed.Streams[i]
+		switch stream.CodecType {
+		case "video":
+			// cover art is stored as a single frame video stream
+			if video == nil && stream.Disposition["attached_pic"] == 0 {
+				video = stream
+			}
+		case "audio":
+			if !metadata.HasAudio {
+				metadata.HasAudio = true
+				metadata.AudioCodec = stream.CodecName
+				metadata.AudioSampleRate, _ = strconv.Atoi(stream.SampleRate)
+				metadata.AudioChannels = stream.Channels
+			}
+		}
+	}
+	metadata.DurationSeconds, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	if video == nil || video.Width <= 0 || video.Height <= 0 {
+		return metadata, nil
+	}
+	metadata.HasVideo = true
+	metadata.VideoCodec = video.CodecName
+	metadata.CodedWidth, metadata.CodedHeight = video.Width, video.Height
+	metadata.Rotation = rotation(video)
+	metadata.Width, metadata.Height = video.Width, video.Height
+	if metadata.Rotation == 90 || metadata.Rotation == 270 {
+		metadata.Width, metadata.Height = video.Height, video.Width
+	}
+	metadata.FrameRate = frameRate(video.AvgFrameRate)
+	if metadata.FrameRate == 0 {
+		metadata.FrameRate = frameRate(video.RFrameRate)
+	}
+	if metadata.DurationSeconds == 0 {
+		metadata.DurationSeconds, _ = strconv.ParseFloat(video.Duration, 64)
+	}
+	return metadata, nil
+}
+
+// rotation reads the clockwise display rotation of a video stream. Newer ffmpeg versions report it in
+// the display matrix side data as a counter clockwise angle, older ones in the rotate tag.
+func rotation(stream *ffprobeStream) int {
+	degrees := 0
+	found := false
+	for _, sideData := range stream.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			degrees = -int(sideData.Rotation)
+			found = true
+			break
+		}
+	}
+	if !found {
+		if tag, ok := stream.Tags["rotate"]; ok {
+			degrees, _ = strconv.Atoi(tag)
+		}
+	}
+	degrees %= 360
+	if degrees < 0 {
+		degrees += 360
+	}
+	// snap to the nearest quarter turn, phones only ever record in those
+	return ((degrees + 45) / 90 % 4) * 90
+}
+
+// frameRate parses a rational frame rate like 30000/1001
+func frameRate(rational string) float64 {
+	numerator, denominator, found := strings.Cut(rational, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
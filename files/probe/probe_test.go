@@ -0,0 +1,65 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/command/commandtest"
+)
+
+// portraitPhone is what ffprobe reports for a portrait video of a phone, stored landscape with a display matrix
+const portraitPhone = `{
+	"streams": [
+		{"codec_type": "video", "codec_name": "hevc", "width": 1920, "height": 1080, "avg_frame_rate": "30000/1001", "r_frame_rate": "30/1",
+		 "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}], "disposition": {"attached_pic": 0}},
+		{"codec_type": "audio", "codec_name": "aac", "sample_rate": "44100", "channels": 2}
+	],
+	"format": {"duration": "12.500000"}
+}`
+
+func TestProbeRotatedVideo(t *testing.T) {
+	recorder := &commandtest.Recorder{Respond: func(cmd command.Cmd) (command.Result, error) {
+		return command.Result{Stdout: []byte(portraitPhone)}, nil
+	}}
+	metadata, err := Probe(context.Background(), recorder, "/work/source.mov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{Width: 1080, Height: 1920, CodedWidth: 1920, CodedHeight: 1080, Rotation: 90, FrameRate: 30000.0 / 1001, DurationSeconds: 12.5,
+		VideoCodec: "hevc", AudioCodec: "aac", HasVideo: true, HasAudio: true, AudioSampleRate: 44100, AudioChannels: 2}
+	if *metadata != want {
+		t.Errorf("got %+v, want %+v", *metadata, want)
+	}
+	commands := recorder.Commands()
+	if len(commands) != 1 || commands[0].Name != "ffprobe" || commands[0].Args[len(commands[0].Args)-1] != "/work/source.mov" {
+		t.Errorf("unexpected commands %v", commands)
+	}
+}
+
+func TestProbeWithoutVideo(t *testing.T) {
+	recorder := &commandtest.Recorder{Respond: func(cmd command.Cmd) (command.Result, error) {
+		return command.Result{Stdout: []byte(`{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {"duration": "3"}}`)}, nil
+	}}
+	_, err := Probe(context.Background(), recorder, "/work/source.mp4")
+	if !errors.Is(err, ErrNoVideoStream) || !exceptions.IsPermanent(err) {
+		t.Errorf("got %v, want a permanent %v", err, ErrNoVideoStream)
+	}
+	metadata, err := ProbeAudio(context.Background(), recorder, "/work/source.mp4")
+	if err != nil || metadata.AudioCodec != "mp3" || metadata.HasVideo {
+		t.Errorf("got %+v, %v", metadata, err)
+	}
+}
+
+func TestProbeClip(t *testing.T) {
+	clip := commandtest.Clip(t, 320, 240, 2)
+	metadata, err := Probe(context.Background(), command.Exec{}, clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Width != 320 || metadata.Height != 240 || metadata.FrameRate != 25 || !metadata.HasAudio {
+		t.Errorf("unexpected metadata %+v", *metadata)
+	}
+}
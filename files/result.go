@@ -0,0 +1,161 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"hangout.com/core/storage-service/database"
+	"hangout.com/core/storage-service/database/model"
+	"hangout.com/core/storage-service/exceptions"
+	"hangout.com/core/storage-service/files/pipeline"
+	"hangout.com/core/storage-service/logger"
+)
+
+// Result is the event queued with every change of the processing status of a file: PROCESSING, SUCCESS with the
+// processed output, FAIL with the error, whether the file is retried or not, and IN_QUEUE when an interrupted job is handed over
+type Result struct {
+	Filename        string               `json:"filename"`
+	UserId          int32                `json:"userId"`
+	ProcessStatus   model.ProcessStatus  `json:"processStatus"`
+	ManifestKey     string               `json:"manifestKey,omitempty"`
+	Manifests       []ResultManifest     `json:"manifests,omitempty"`
+	Renditions      []pipeline.Rendition `json:"renditions,omitempty"`
+	DurationSeconds float64              `json:"durationSeconds,omitempty"`
+	Poster          *ResultImage         `json:"poster,omitempty"`
+	Thumbnails      []ResultImage        `json:"thumbnails,omitempty"`
+	Storyboard      *ResultStoryboard    `json:"storyboard,omitempty"`
+	Variants        []ResultImage        `json:"variants,omitempty"`
+	Blurhash        string               `json:"blurhash,omitempty"`
+	WaveformKey     string               `json:"waveformKey,omitempty"`
+	Progressive     []ResultFile         `json:"progressive,omitempty"`
+	Error           *ResultError         `json:"error,omitempty"`
+}
+
+// ResultManifest is a playlist of the processed file and the video codecs it offers
+type ResultManifest struct {
+	Key    string   `json:"key"`
+	Format string   `json:"format"`
+	Codecs []string `json:"codecs"`
+}
+
+// ResultImage is a still image of the processed file, a preview of a video or a variant of an image
+type ResultImage struct {
+	Key    string `json:"key"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ResultStoryboard is the seek preview of the processed file. The WebVTT track refers to the sprite sheets
+// by their names relative to it, with the tile given as a #xywh fragment.
+type ResultStoryboard struct {
+	TrackKey        string   `json:"trackKey"`
+	SpriteKeys      []string `json:"spriteKeys"`
+	IntervalSeconds float64  `json:"intervalSeconds"`
+	TileWidth       int      `json:"tileWidth"`
+	TileHeight      int      `json:"tileHeight"`
+	Columns         int      `json:"columns"`
+	Rows            int      `json:"rows"`
+}
+
+// ResultFile is a progressive audio file of the processed file
+type ResultFile struct {
+	Key     string `json:"key"`
+	Codec   string `json:"codec"`
+	Bitrate string `json:"bitrate"`
+}
+
+// ResultError describes why processing failed
+type ResultError struct {
+	Stage    string `json:"stage"`
+	Detail   string `json:"detail,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Message  string `json:"message"`
+}
+
+// KeyPrefix returns the object key prefix under which the processed output of the file is stored
+func (f *File) KeyPrefix() string {
+	return strings.Split(f.Filename, ".")[0]
+}
+
+// Result builds the processing result of the file
+func (f *File) Result(status model.ProcessStatus, stage string, cause error) *Result {
+	result := &Result{Filename: f.Filename, UserId: f.UserId, ProcessStatus: status}
+	if f.Output != nil {
+		if f.Output.Manifest != "" {
+			result.ManifestKey = f.KeyPrefix() + "/" + f.Output.Manifest
+		}
+		for _, manifest := range f.Output.Manifests {
+			result.Manifests = append(result.Manifests, ResultManifest{Key: f.KeyPrefix() + "/" + manifest.Name, Format: manifest.Format, Codecs: manifest.Codecs})
+		}
+		result.Renditions = f.Output.Renditions
+		result.DurationSeconds = f.Output.DurationSeconds
+		for _, variant := range f.Output.Variants {
+			result.Variants = append(result.Variants, *f.resultImage(variant))
+		}
+		result.Blurhash = f.Output.Blurhash
+		if f.Output.Waveform != "" {
+			result.WaveformKey = f.KeyPrefix() + "/" + f.Output.Waveform
+		}
+		for _, progressive := range f.Output.Progressive {
+			result.Progressive = append(result.Progressive, ResultFile{Key: f.KeyPrefix() + "/" + progressive.Name, Codec: progressive.Codec, Bitrate: progressive.Bitrate})
+		}
+		if previews := f.Output.Previews; previews != nil {
+			result.Poster = f.resultImage(previews.Poster)
+			for _, thumbnail := range previews.Thumbnails {
+				result.Thumbnails = append(result.Thumbnails, *f.resultImage(thumbnail))
+			}
+			if storyboard := previews.Storyboard; storyboard != nil {
+				result.Storyboard = &ResultStoryboard{
+					TrackKey:        f.KeyPrefix() + "/" + storyboard.Track,
+					IntervalSeconds: storyboard.IntervalSeconds,
+					TileWidth:       storyboard.TileWidth,
+					TileHeight:      storyboard.TileHeight,
+					Columns:         storyboard.Columns,
+					Rows:            storyboard.Rows,
+				}
+				for _, sprite := range storyboard.Sprites {
+					result.Storyboard.SpriteKeys = append(result.Storyboard.SpriteKeys, f.KeyPrefix()+"/"+sprite)
+				}
+			}
+		}
+	}
+	if cause != nil {
+		result.Error = &ResultError{Stage: stage, Message: cause.Error()}
+		var stageErr *exceptions.StageError
+		if errors.As(cause, &stageErr) {
+			result.Error.Detail = stageErr.Detail
+			if stageErr.ExitCode > 0 {
+				result.Error.ExitCode = stageErr.ExitCode
+			}
+		}
+	}
+	return result
+}
+
+func (f *File) resultImage(image pipeline.StillImage) *ResultImage {
+	return &ResultImage{Key: f.KeyPrefix() + "/" + image.Name, Format: image.Format, Width: image.Width, Height: image.Height}
+}
+
+// UpdateStatus moves the file to the given status and queues the matching result event in the outbox in the
+// same transaction. Every status change goes through it, so that the events never disagree with media.
+// The event is only queued when a result topic is configured.
+func (f *File) UpdateStatus(ctx context.Context, cfg *koanf.Koanf, dbConnPool *database.DatabaseConnectionPool, status model.ProcessStatus, stage string, cause error, log logger.Log) error {
+	var event *database.OutboxMessage
+	if topic := cfg.String("kafka.result-topic"); topic != "" {
+		payload, err := json.Marshal(f.Result(status, stage, cause))
+		if err != nil {
+			return err
+		}
+		headers := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, headers)
+		headers["content-type"] = "application/json"
+		event = &database.OutboxMessage{Topic: topic, Key: f.Filename, Payload: payload, Headers: headers}
+	}
+	return dbConnPool.UpdateProcessingStatus(ctx, f.Filename, status, event, log)
+}
@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// Task is a step of a job that can run as soon as the tasks it comes after are done
+type Task struct {
+	Name string
+	// After names the tasks that have to succeed before this one starts
+	After []string
+	// Slots is how many of the CPU slots of the process the task holds while it runs, none for tasks
+	// that hardly use the CPU. A task never waits for more slots than there are.
+	Slots int
+	Run   func(ctx context.Context) error
+}
+
+// Run executes the tasks as a graph, every task once all tasks it comes after succeeded, with at most
+// concurrency tasks of the job running at a time and tasks that need CPU slots also waiting for them.
+// The first failure cancels the running tasks, no further task starts and its error is returned.
+// Tasks that were still waiting return the cause of the cancellation.
+func Run(ctx context.Context, tasks []Task, concurrency int, slots *Slots) error {
+	if err := validate(tasks); err != nil {
+		return err
+	}
+	span := trace.SpanFromContext(ctx)
+	group, ctx := errgroup.WithContext(ctx)
+	done := make(map[string]chan struct{}, len(tasks))
+	for _, task := range tasks {
+		done[task.Name] = make(chan struct{})
+	}
+	running := make(chan struct{}, max(1, concurrency))
+	for _, task := range tasks {
+		group.Go(func() error {
+			for _, name := range task.After {
+				select {
+				case <-done[name]:
+				case <-ctx.Done():
+					return context.Cause(ctx)
+				}
+			}
+			queued := time.Now()
+			select {
+			case running <- struct{}{}:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+			defer func() { <-running }()
+			if task.Slots > 0 {
+				held, err := slots.acquire(ctx, task.Slots)
+				if err != nil {
+					return context.Cause(ctx)
+				}
+				defer slots.release(held)
+			}
+			span.AddEvent("task.started", trace.WithAttributes(
+				attribute.String("task", task.Name),
+				attribute.Int64("task.wait_ms", time.Since(queued).Milliseconds()),
+			))
+			if err := task.Run(ctx); err != nil {
+				return err
+			}
+			close(done[task.Name])
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+// validate makes sure every task is named once, depends on known tasks only and that there is no cycle,
+// which would leave its tasks waiting for each other forever
+func validate(tasks []Task) error {
+	after := make(map[string][]string, len(tasks))
+	for _, task := range tasks {
+		if _, ok := after[task.Name]; ok {
+			return fmt.Errorf("task %q is defined twice", task.Name)
+		}
+		after[task.Name] = task.After
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(tasks))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("task %q is part of a dependency cycle", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dependency := range after[name] {
+			if _, ok := after[dependency]; !ok {
+				return fmt.Errorf("task %q comes after unknown task %q", name, dependency)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, task := range tasks {
+		if err := visit(task.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
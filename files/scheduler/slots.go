@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/knadh/koanf/v2"
+	"golang.org/x/sync/semaphore"
+)
+
+// Slots limits how many CPU heavy tasks, like an ffmpeg encode, run at the same time across every job of the process
+type Slots struct {
+	semaphore *semaphore.Weighted
+	size      int
+}
+
+// NewSlots creates the CPU slots of the process from process.cpu-slots, one per CPU if it is not set
+func NewSlots(cfg *koanf.Koanf) *Slots {
+	size := cfg.Int("process.cpu-slots")
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	return &Slots{semaphore: semaphore.NewWeighted(int64(size)), size: size}
+}
+
+// Size is the number of tasks that can hold a slot at the same time
+func (s *Slots) Size() int {
+	return s.size
+}
+
+// acquire blocks until count slots, or all of them if there are fewer, are free or ctx is done.
+// It returns how many slots it took. Nil slots do not limit anything.
+func (s *Slots) acquire(ctx context.Context, count int) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	count = min(count, s.size)
+	return count, s.semaphore.Acquire(ctx, int64(count))
+}
+
+func (s *Slots) release(count int) {
+	if s != nil && count > 0 {
+		s.semaphore.Release(int64(count))
+	}
+}
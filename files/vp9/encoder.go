@@ -0,0 +1,57 @@
+package vp9
+
+import (
+	"hangout.com/core/storage-service/files/ladder"
+	"hangout.com/core/storage-service/files/pipeline"
+)
+
+func init() {
+	pipeline.Register(encoder{})
+}
+
+// encoder encodes VP9 with libvpx in two passes
+type encoder struct{}
+
+func (encoder) Name() string {
+	return "vp9"
+}
+
+func (encoder) Passes() int {
+	return 2
+}
+
+// VideoArgs encodes a rendition with a target bitrate in constrained quality mode, otherwise in constant quality mode
+func (encoder) VideoArgs(rung ladder.Rung) []string {
+	deadline := rung.Preset
+	if deadline == "" {
+		deadline = "good"
+	}
+	args := []string{"-c:v", "libvpx-vp9", "-quality", deadline, "-speed", "4", "-row-mt", "1", "-tile-columns", tileColumns(rung)}
+	args = append(args, pipeline.ConstrainedQualityArgs(rung)...)
+	return append(args, pipeline.KeyframeArgs(rung)...)
+}
+
+func (encoder) Container() string {
+	return "mp4"
+}
+
+func (encoder) Audio() pipeline.AudioCodec {
+	return pipeline.AudioCodec{Name: "opus", Encoder: "libopus"}
+}
+
+func (encoder) Packaging() pipeline.PackagingHints {
+	return pipeline.PackagingHints{}
+}
+
+// tileColumns returns log2 of the number of tile columns, larger pictures are split into more
+// columns so that they can be encoded on more threads
+func tileColumns(rung ladder.Rung) string {
+	switch short := min(rung.Width, rung.Height); {
+	case short >= 1080:
+		return "3"
+	case short >= 720:
+		return "2"
+	default:
+		return "1"
+	}
+}
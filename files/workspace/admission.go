@@ -0,0 +1,80 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/exceptions"
+)
+
+// ErrInsufficientSpace is returned by Admit for jobs whose source and estimated output do not fit on the disk
+var ErrInsufficientSpace = errors.New("not enough free disk space")
+
+// limits are how much disk space a job is expected to take, from process.workspace
+type limits struct {
+	// outputFactor is the size of the output and intermediate files as a multiple of the size of the source
+	outputFactor float64
+	// minFree is the space that has to stay free on the disk, in bytes
+	minFree int64
+}
+
+var defaultLimits = limits{outputFactor: 4, minFree: 1 << 30}
+
+func loadLimits(cfg *koanf.Koanf) limits {
+	l := defaultLimits
+	if factor := cfg.Float64("process.workspace.output-factor"); factor > 0 {
+		l.outputFactor = factor
+	}
+	if cfg.Get("process.workspace.min-free-mb") != nil {
+		l.minFree = cfg.Int64("process.workspace.min-free-mb") << 20
+	}
+	return l
+}
+
+// reservations is the disk space set aside by the jobs of this process that are running. Free space
+// does not yet account for the output those jobs are still going to write.
+var reservations = struct {
+	sync.Mutex
+	total int64
+}{}
+
+// Admit checks that a source of the given size and its estimated output fit on the disk of the workspace,
+// next to the space reserved by the other running jobs, and reserves it until Remove.
+// A job that does not fit now is a transient failure, so that it is retried once other jobs are done.
+// A job that would not fit even on an empty disk is refused for good.
+func (w *Workspace) Admit(sourceSize int64) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(w.dir, &stat); err != nil {
+		return exceptions.NewStageError(exceptions.StageAdmission, "statfs", err)
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	capacity := int64(stat.Blocks) * int64(stat.Bsize)
+	needed := sourceSize + int64(float64(sourceSize)*w.limits.outputFactor)
+	if needed+w.limits.minFree > capacity {
+		return exceptions.NewPermanentStageError(exceptions.StageAdmission, sizes(needed, capacity),
+			fmt.Errorf("%w, the job needs more than the whole disk", ErrInsufficientSpace))
+	}
+	reservations.Lock()
+	defer reservations.Unlock()
+	if free := available - reservations.total - w.limits.minFree; needed > free {
+		return exceptions.NewStageError(exceptions.StageAdmission, sizes(needed, max(0, free)), ErrInsufficientSpace)
+	}
+	w.reserved = needed
+	reservations.total += needed
+	return nil
+}
+
+// release returns the disk space reserved for the workspace
+func release(w *Workspace) {
+	reservations.Lock()
+	defer reservations.Unlock()
+	reservations.total -= w.reserved
+	w.reserved = 0
+}
+
+func sizes(needed int64, free int64) string {
+	return fmt.Sprintf("needs %d MiB, %d MiB free", needed>>20, free>>20)
+}
@@ -0,0 +1,210 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+)
+
+// jobPattern is the name pattern of job directories under the directory of the process
+const jobPattern = "hangout-job-*"
+
+// instancePattern is the name pattern of the directories the processes sharing the work root keep their jobs in
+const instancePattern = "hangout-instance-*"
+
+// lockName is the lock file in the directory of a process, locked for as long as the process runs
+const lockName = ".lock"
+
+// unlockedGracePeriod is how long a process directory may exist without a lock file before it is swept,
+// the time between its creation and the lock being taken
+const unlockedGracePeriod = time.Minute
+
+// ErrOutsideWorkspace is returned by Join for paths that would leave the workspace
+var ErrOutsideWorkspace = errors.New("path leaves the workspace")
+
+// unsafeCharacters are replaced in names derived from the uploaded filename
+var unsafeCharacters = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Workspace is the scratch directory of a single job, a directory of its own under the work root.
+// The source is downloaded into it and the pipelines write everything that gets uploaded into its output folder.
+type Workspace struct {
+	dir    string
+	name   string
+	source string
+	// reserved is the disk space Admit set aside for the job
+	reserved int64
+	limits   limits
+}
+
+// instance is the directory of this process under the work root. Its lock file stays locked while the process
+// runs, so that the processes sharing a work root can tell live directories from the ones of a dead process.
+var instance = struct {
+	sync.Mutex
+	root string
+	dir  string
+	lock *os.File
+}{}
+
+// Root returns the work root from process.workspace.root, the temporary directory of the system if it is not set
+func Root(cfg *koanf.Koanf) string {
+	if root := cfg.String("process.workspace.root"); root != "" {
+		return root
+	}
+	return os.TempDir()
+}
+
+// New creates a workspace with a unique directory under the directory of the process for the uploaded file
+func New(cfg *koanf.Koanf, filename string) (*Workspace, error) {
+	root, err := instanceDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(root, jobPattern)
+	if err != nil {
+		return nil, err
+	}
+	w := &Workspace{dir: dir, name: safeName(filename), limits: loadLimits(cfg)}
+	// the extension is kept as a hint for ffmpeg, the rest of the filename is not trusted
+	w.source, err = w.Join("source" + safeExtension(filename))
+	if err == nil {
+		err = os.Mkdir(w.Output(), 0755)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Dir is the directory of the workspace
+func (w *Workspace) Dir() string {
+	return w.dir
+}
+
+// Name is the base name of the uploaded file without its extension and with everything but letters,
+// digits, dashes and underscores replaced. The pipelines name their playlists after it.
+func (w *Workspace) Name() string {
+	return w.name
+}
+
+// Source is the path the uploaded file is downloaded to
+func (w *Workspace) Source() string {
+	return w.source
+}
+
+// Output is the folder whose content is uploaded once the file is processed
+func (w *Workspace) Output() string {
+	return filepath.Join(w.dir, "output")
+}
+
+// Join joins the elements to the directory of the workspace and fails if the result is not inside of it
+func (w *Workspace) Join(elem ...string) (string, error) {
+	path := filepath.Join(append([]string{w.dir}, elem...)...)
+	relative, err := filepath.Rel(w.dir, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideWorkspace, filepath.Join(elem...))
+	}
+	return path, nil
+}
+
+// Remove deletes the workspace with everything in it and releases the disk space reserved for it.
+// It is safe to call more than once.
+func (w *Workspace) Remove() error {
+	release(w)
+	return os.RemoveAll(w.dir)
+}
+
+// Sweep removes the directories left under the work root by processes that did not get to clean up, for
+// example because they were killed. The work root may be shared by several processes, only directories whose
+// lock file is no longer locked are removed. Leftovers of this process must be removed before it runs any job.
+func Sweep(cfg *koanf.Koanf) ([]string, error) {
+	own, err := instanceDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob(filepath.Join(Root(cfg), instancePattern))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, dir := range dirs {
+		if dir == own || !abandoned(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// instanceDir returns the directory of this process under the work root, creating and locking it on first use
+func instanceDir(cfg *koanf.Koanf) (string, error) {
+	root := Root(cfg)
+	instance.Lock()
+	defer instance.Unlock()
+	if instance.dir != "" && instance.root == root {
+		return instance.dir, nil
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(root, instancePattern)
+	if err != nil {
+		return "", err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not lock %s: %w", dir, err)
+	}
+	// the lock is released by the kernel when the process exits, however it exits
+	instance.root, instance.dir, instance.lock = root, dir, lock
+	return dir, nil
+}
+
+// abandoned reports whether the process directory belongs to a process that is not running anymore
+func abandoned(dir string) bool {
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		info, err := os.Stat(dir)
+		return err == nil && time.Since(info.ModTime()) > unlockedGracePeriod
+	}
+	if err != nil {
+		return false
+	}
+	defer lock.Close()
+	return syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
+
+func safeName(filename string) string {
+	base := filepath.Base(filepath.FromSlash(filename))
+	name := strings.Trim(unsafeCharacters.ReplaceAllString(strings.TrimSuffix(base, filepath.Ext(base)), "_"), "_")
+	if name == "" {
+		return "media"
+	}
+	return name
+}
+
+func safeExtension(filename string) string {
+	extension := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if extension == "" || unsafeCharacters.MatchString(extension) {
+		return ""
+	}
+	return "." + strings.ToLower(extension)
+}
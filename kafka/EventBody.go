@@ -1,7 +1,10 @@
 package kafka
 
 type eventBody struct {
+	Version     string `json:"version,omitempty"`
 	Filename    string `json:"filename"`
 	ContentType string `json:"contentType"`
 	UserId      int32  `json:"userId"`
+	// Profile optionally names the ladder profile the file should be encoded with
+	Profile string `json:"profile,omitempty"`
 }
@@ -0,0 +1,308 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// avroType is a node of a parsed avro schema
+type avroType struct {
+	kind     string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	values   *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// compileAvroSchema parses the writer schema of an avro encoded upload event.
+// The top level type has to be a record.
+func compileAvroSchema(schema *Schema) (recordDecoder, error) {
+	var definition any
+	if err := json.Unmarshal([]byte(schema.Schema), &definition); err != nil {
+		return nil, err
+	}
+	parser := &avroParser{names: map[string]*avroType{}}
+	root, err := parser.parse(definition, "")
+	if err != nil {
+		return nil, err
+	}
+	if root.kind != "record" {
+		return nil, errors.New("avro schema must be a record, got " + root.kind)
+	}
+	return func(payload []byte) (map[string]any, error) {
+		reader := &avroReader{buf: payload}
+		value, err := reader.read(root)
+		if err != nil {
+			return nil, err
+		}
+		return value.(map[string]any), nil
+	}, nil
+}
+
+type avroParser struct {
+	names map[string]*avroType
+}
+
+func (p *avroParser) parse(definition any, namespace string) (*avroType, error) {
+	switch d := definition.(type) {
+	case string:
+		if avroPrimitives[d] {
+			return &avroType{kind: d}, nil
+		}
+		if named, ok := p.names[fullName(d, namespace)]; ok {
+			return named, nil
+		}
+		if named, ok := p.names[d]; ok {
+			return named, nil
+		}
+		return nil, errors.New("unknown avro type " + d)
+	case []any:
+		union := &avroType{kind: "union"}
+		for _, branch := range d {
+			t, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+	case map[string]any:
+		return p.parseComplex(d, namespace)
+	default:
+		return nil, fmt.Errorf("invalid avro schema node %v", definition)
+	}
+}
+
+func (p *avroParser) parseComplex(d map[string]any, namespace string) (*avroType, error) {
+	kind, _ := d["type"].(string)
+	if ns, ok := d["namespace"].(string); ok {
+		namespace = ns
+	}
+	name, _ := d["name"].(string)
+	switch kind {
+	case "record", "error":
+		record := &avroType{kind: "record", name: fullName(name, namespace)}
+		p.names[record.name] = record
+		if strings.Contains(record.name, ".") {
+			namespace = record.name[:strings.LastIndex(record.name, ".")]
+		}
+		fields, _ := d["fields"].([]any)
+		for _, f := range fields {
+			field, ok := f.(map[string]any)
+			if !ok {
+				return nil, errors.New("invalid avro record field in " + record.name)
+			}
+			fieldName, _ := field["name"].(string)
+			t, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			record.fields = append(record.fields, avroField{name: fieldName, typ: t})
+		}
+		return record, nil
+	case "enum":
+		enum := &avroType{kind: "enum", name: fullName(name, namespace)}
+		symbols, _ := d["symbols"].([]any)
+		for _, symbol := range symbols {
+			enum.symbols = append(enum.symbols, fmt.Sprint(symbol))
+		}
+		p.names[enum.name] = enum
+		return enum, nil
+	case "fixed":
+		size, _ := d["size"].(float64)
+		fixed := &avroType{kind: "fixed", name: fullName(name, namespace), size: int(size)}
+		p.names[fixed.name] = fixed
+		return fixed, nil
+	case "array":
+		items, err := p.parse(d["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: "array", items: items}, nil
+	case "map":
+		values, err := p.parse(d["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: "map", values: values}, nil
+	default:
+		// primitives may be written as {"type": "string", "logicalType": ...}
+		return p.parse(kind, namespace)
+	}
+}
+
+func fullName(name string, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroReader decodes the avro binary encoding
+type avroReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *avroReader) read(t *avroType) (any, error) {
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int":
+		v, err := r.long()
+		return int32(v), err
+	case "long":
+		return r.long()
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes":
+		return r.bytes()
+	case "string":
+		b, err := r.bytes()
+		return string(b), err
+	case "fixed":
+		return r.next(t.size)
+	case "enum":
+		index, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(t.symbols) {
+			return nil, fmt.Errorf("enum index %d out of range for %s", index, t.name)
+		}
+		return t.symbols[index], nil
+	case "union":
+		index, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(t.branches) {
+			return nil, fmt.Errorf("union branch %d out of range", index)
+		}
+		return r.read(t.branches[index])
+	case "record":
+		record := make(map[string]any, len(t.fields))
+		for _, field := range t.fields {
+			value, err := r.read(field.typ)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.name, err)
+			}
+			record[field.name] = value
+		}
+		return record, nil
+	case "array":
+		var items []any
+		err := r.blocks(func() error {
+			item, err := r.read(t.items)
+			items = append(items, item)
+			return err
+		})
+		return items, err
+	case "map":
+		values := map[string]any{}
+		err := r.blocks(func() error {
+			key, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			value, err := r.read(t.values)
+			values[string(key)] = value
+			return err
+		})
+		return values, err
+	default:
+		return nil, errors.New("unsupported avro type " + t.kind)
+	}
+}
+
+// blocks reads the block encoding used by arrays and maps
+func (r *avroReader) blocks(item func() error) error {
+	for {
+		count, err := r.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			count = -count
+			// the block size in bytes follows a negative count
+			if _, err = r.long(); err != nil {
+				return err
+			}
+		}
+		// a count the rest of the payload can not hold comes from a corrupt or hostile message
+		if count < 0 || count > int64(len(r.buf)-r.pos) {
+			return fmt.Errorf("invalid block count %d", count)
+		}
+		for i := int64(0); i < count; i++ {
+			if err = item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *avroReader) long() (int64, error) {
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *avroReader) bytes() ([]byte, error) {
+	length, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("negative length %d", length)
+	}
+	return r.next(int(length))
+}
+
+func (r *avroReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
@@ -2,31 +2,54 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/IBM/sarama"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 	"hangout.com/core/storage-service/files"
 	"hangout.com/core/storage-service/logger"
 )
 
+// Backoff between tries to decode an event while the schema registry is unavailable
+const (
+	registryRetryMin = time.Second
+	registryRetryMax = 30 * time.Second
+)
+
+// partitionPauser is the part of sarama.ConsumerGroup used to apply backpressure
+type partitionPauser interface {
+	Pause(partitions map[string][]int32)
+	Resume(partitions map[string][]int32)
+}
+
 // ConsumerGroupHandler implements sarama.ConsumerGroupHandler
 type ConsumerGroupHandler struct {
-	Files chan<- *files.File
-	ctx   context.Context
-	log   logger.Log
+	Files        chan<- *files.File
+	partitions   partitionPauser
+	producer     *Producer
+	decoder      Decoder
+	inflight     *inflightTracker
+	drainTimeout time.Duration
+	ctx          context.Context
+	log          logger.Log
 }
 
 // Setup runs at the beginning of a new session, before ConsumeClaim
-func (cgh *ConsumerGroupHandler) Setup(sarama.ConsumerGroupSession) error {
-	cgh.log.Info(cgh.ctx, "Consumer group session setup completed")
+func (cgh *ConsumerGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	initConsumerMetrics()
+	cgh.log.Info(cgh.ctx, "Consumer group session setup completed", "claims", session.Claims())
 	return nil
 }
 
-// Cleanup runs at the end of a session, once all ConsumeClaim goroutines have exited
+// Cleanup runs at the end of a session, once all ConsumeClaim goroutines have exited.
+// The partitions of the session may move to another instance, so in-flight jobs are drained first.
 func (cgh *ConsumerGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	cgh.inflight.drain(cgh.ctx, cgh.drainTimeout, cgh.log)
 	cgh.log.Info(cgh.ctx, "Consumer group session cleanup completed")
 	return nil
 }
@@ -46,41 +69,186 @@ func (cgh *ConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSessio
 			attribute.String("messaging.destination", message.Topic),
 			attribute.Int64("messaging.kafka.partition", int64(message.Partition)),
 			attribute.Int64("messaging.kafka.offset", message.Offset),
+			attribute.Int("messaging.kafka.attempt", attemptOf(message)),
 		)
-		var body eventBody
-		err := json.Unmarshal(message.Value, &body)
+		jobCtx, job := cgh.inflight.track(ctx, session, message)
+		envelope, err := cgh.parse(ctx, session, message)
+		if errors.Is(err, ErrSchemaRegistryUnavailable) {
+			cgh.log.Info(ctx, "Session ended while the schema registry was unavailable, leaving event for redelivery")
+			job.Finish()
+			span.End()
+			return nil
+		}
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			cgh.log.Error(ctx, "error in unmarshalling", err)
-		} else {
-			event := files.File{
-				Context:      ctx,
-				Filename:     body.Filename,
-				ContentType:  body.ContentType,
-				UserId:       body.UserId,
-				KafkaMessage: message,
-				KafkaSession: session,
-			}
-			cgh.log.Debug(ctx, "File Upload event occured",
-				"Topic", message.Topic,
-				"Partition", message.Partition,
-				"Offset", message.Offset,
-				"Value", string(message.Value),
-			)
-			select {
-			case cgh.Files <- &event:
-				cgh.log.Info(ctx, "Accepting File upload event", "Channel capacity", cap(cgh.Files)-len(cgh.Files))
-				consumedEventsCounter.Add(ctx, 1) // <-- increment counter
-				span.End()
-			default:
-				cgh.log.Warn(ctx, "File channel is full, unable to process event",
-					"Channel capacity", cap(cgh.Files)-len(cgh.Files),
-				)
-				span.End()
-			}
+			cgh.log.Error(ctx, "could not parse upload event", "error", err)
+			cgh.deadLetter(ctx, job, message, "parse", err)
+			job.Finish()
+			span.End()
+			continue
 		}
-
+		span.SetAttributes(
+			attribute.String("event.id", envelope.id),
+			attribute.String("event.source", envelope.source),
+			attribute.String("event.schemaVersion", envelope.schemaVersion),
+		)
+		job.filename = envelope.body.Filename
+		event := files.File{
+			Context:       jobCtx,
+			Filename:      envelope.body.Filename,
+			ContentType:   envelope.body.ContentType,
+			Profile:       envelope.body.Profile,
+			UserId:        envelope.body.UserId,
+			EventId:       envelope.id,
+			EventSource:   envelope.source,
+			EventTime:     envelope.time,
+			SchemaVersion: envelope.schemaVersion,
+			KafkaMessage:  message,
+			KafkaSession:  session,
+			Lease:         job,
+		}
+		cgh.log.Debug(ctx, "File Upload event occured",
+			"Topic", message.Topic,
+			"Partition", message.Partition,
+			"Offset", message.Offset,
+			"Value", string(message.Value),
+		)
+		if !cgh.waitUntilDue(ctx, session, message) {
+			cgh.log.Info(ctx, "Session ended while waiting for a retry to be due, leaving event for redelivery")
+			job.Finish()
+			span.End()
+			return nil
+		}
+		if !cgh.dispatch(ctx, session, message, &event) {
+			cgh.log.Info(ctx, "Session ended while waiting for a free worker, leaving event for redelivery")
+			job.Finish()
+			span.End()
+			return nil
+		}
+		cgh.log.Info(ctx, "Accepting File upload event", "Channel capacity", cap(cgh.Files)-len(cgh.Files))
+		consumedEventsCounter.Add(ctx, 1) // <-- increment counter
+		span.End()
 	}
 	return nil
 }
+
+// parse decodes the event. While the schema registry is unavailable the partition is paused and the event
+// is decoded again with a backoff, so that it stays unacknowledged instead of being dead-lettered.
+// The registry error is only returned if the session ends first.
+func (cgh *ConsumerGroupHandler) parse(ctx context.Context, session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) (*envelope, error) {
+	envelope, err := parseEnvelope(ctx, message, cgh.decoder)
+	if !errors.Is(err, ErrSchemaRegistryUnavailable) {
+		return envelope, err
+	}
+	resume := cgh.pause(ctx, message, "schema-registry")
+	defer resume()
+
+	backoff := registryRetryMin
+	for errors.Is(err, ErrSchemaRegistryUnavailable) {
+		cgh.log.Warn(ctx, "schema registry is unavailable, decoding the event again later", "retry-in", backoff.String(), "error", err)
+		trace.SpanFromContext(ctx).RecordError(err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-session.Context().Done():
+			timer.Stop()
+			return nil, err
+		}
+		backoff = min(2*backoff, registryRetryMax)
+		envelope, err = parseEnvelope(ctx, message, cgh.decoder)
+	}
+	return envelope, err
+}
+
+// dispatch hands the event over to the worker pool.
+// When the channel is full the partition is paused so that no more records are fetched for it,
+// and the send blocks until a worker picks up an event or the session ends.
+// It returns false if the session ended before the event could be handed over.
+func (cgh *ConsumerGroupHandler) dispatch(ctx context.Context, session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, event *files.File) bool {
+	select {
+	case cgh.Files <- event:
+		return true
+	default:
+	}
+
+	cgh.log.Warn(ctx, "File channel is full, pausing partition until a worker is free",
+		"Topic", message.Topic,
+		"Partition", message.Partition,
+		"Channel capacity", cap(cgh.Files)-len(cgh.Files),
+	)
+	resume := cgh.pause(ctx, message, "backpressure")
+	defer resume()
+
+	select {
+	case cgh.Files <- event:
+		return true
+	case <-session.Context().Done():
+		return false
+	}
+}
+
+// waitUntilDue holds back a message from a retry topic until its not-before time has passed.
+// The partition stays paused while waiting, as every later record on it is due even later.
+// It returns false if the session ended while waiting.
+func (cgh *ConsumerGroupHandler) waitUntilDue(ctx context.Context, session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) bool {
+	due, ok := notBefore(message)
+	if !ok {
+		return true
+	}
+	wait := time.Until(due)
+	if wait <= 0 {
+		return true
+	}
+	cgh.log.Info(ctx, "Retry is not due yet, pausing partition",
+		"Topic", message.Topic,
+		"Partition", message.Partition,
+		"not-before", due.Format(time.RFC3339),
+	)
+	resume := cgh.pause(ctx, message, "retry-delay")
+	defer resume()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-session.Context().Done():
+		return false
+	}
+}
+
+// pause stops fetching from the partition of the message and records it as a metric and span event.
+// The returned function resumes the partition.
+func (cgh *ConsumerGroupHandler) pause(ctx context.Context, message *sarama.ConsumerMessage, reason string) func() {
+	span := trace.SpanFromContext(ctx)
+	partition := map[string][]int32{message.Topic: {message.Partition}}
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.destination", message.Topic),
+		attribute.Int64("messaging.kafka.partition", int64(message.Partition)),
+		attribute.String("pause.reason", reason),
+	}
+	cgh.partitions.Pause(partition)
+	partitionPausedCounter.Add(ctx, 1, metric.WithAttributes(attrs...))
+	span.AddEvent("partition.paused", trace.WithAttributes(attrs...))
+	pausedAt := time.Now()
+	return func() {
+		cgh.partitions.Resume(partition)
+		pausedFor := time.Since(pausedAt)
+		partitionResumeCounter.Add(ctx, 1, metric.WithAttributes(attrs...))
+		partitionPauseDuration.Record(ctx, pausedFor.Seconds(), metric.WithAttributes(attrs...))
+		span.AddEvent("partition.resumed", trace.WithAttributes(append(attrs, attribute.Int64("paused.ms", pausedFor.Milliseconds()))...))
+		cgh.log.Info(ctx, "Resumed partition", "Topic", message.Topic, "Partition", message.Partition, "paused-for", pausedFor.String())
+	}
+}
+
+// deadLetter moves a message that can never be processed to the dead letter topic and
+// acknowledges it, so that it does not block the partition
+func (cgh *ConsumerGroupHandler) deadLetter(ctx context.Context, job *inflightJob, message *sarama.ConsumerMessage, stage string, err error) {
+	failure := Failure{Stage: stage, Err: err, WorkerId: ConsumerWorkerId}
+	if publishErr := cgh.producer.PublishDeadLetter(ctx, message, failure); publishErr != nil {
+		cgh.log.Error(ctx, "could not move message to dead letter topic, leaving it unacknowledged", "error", publishErr)
+		return
+	}
+	job.Acknowledge()
+}
@@ -8,8 +8,12 @@ import (
 )
 
 var (
-	consumedEventsCounter metric.Int64Counter
-	initMetricsOnce       sync.Once
+	consumedEventsCounter  metric.Int64Counter
+	partitionPausedCounter metric.Int64Counter
+	partitionResumeCounter metric.Int64Counter
+	partitionPauseDuration metric.Float64Histogram
+	abandonedJobsCounter   metric.Int64Counter
+	initMetricsOnce        sync.Once
 )
 
 func initConsumerMetrics() {
@@ -19,5 +23,22 @@ func initConsumerMetrics() {
 			"kafka_consumer_events_consumed_total",
 			metric.WithDescription("Total number of Kafka events consumed"),
 		)
+		partitionPausedCounter, _ = meter.Int64Counter(
+			"kafka_consumer_partition_pauses_total",
+			metric.WithDescription("Number of times a partition was paused because the worker channel was full"),
+		)
+		partitionResumeCounter, _ = meter.Int64Counter(
+			"kafka_consumer_partition_resumes_total",
+			metric.WithDescription("Number of times a paused partition was resumed"),
+		)
+		partitionPauseDuration, _ = meter.Float64Histogram(
+			"kafka_consumer_partition_pause_duration",
+			metric.WithDescription("Time a partition stayed paused in seconds"),
+			metric.WithUnit("s"),
+		)
+		abandonedJobsCounter, _ = meter.Int64Counter(
+			"kafka_consumer_abandoned_jobs_total",
+			metric.WithDescription("Number of running jobs cancelled because their partition was revoked"),
+		)
 	})
 }
@@ -21,3 +21,31 @@ func (c kafkaHeaderCarrier) Keys() []string {
 	}
 	return keys
 }
+
+// Helper type to adapt Sarama producer headers to OpenTelemetry TextMapCarrier
+type kafkaProducerHeaderCarrier []sarama.RecordHeader
+
+func (c *kafkaProducerHeaderCarrier) Get(key string) string {
+	for _, h := range *c {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+func (c *kafkaProducerHeaderCarrier) Set(key, value string) {
+	for i, h := range *c {
+		if string(h.Key) == key {
+			(*c)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c = append(*c, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+func (c *kafkaProducerHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c))
+	for _, h := range *c {
+		keys = append(keys, string(h.Key))
+	}
+	return keys
+}
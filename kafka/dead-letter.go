@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers attached to every record published to the dead letter topic
+const (
+	headerAttempt           = "x-attempt"
+	headerDLQStage          = "x-dlq-stage"
+	headerDLQError          = "x-dlq-error"
+	headerDLQAttempt        = "x-dlq-attempt"
+	headerDLQWorkerId       = "x-dlq-worker-id"
+	headerDLQTraceId        = "x-dlq-trace-id"
+	headerDLQOriginalTopic  = "x-dlq-original-topic"
+	headerDLQOriginalOffset = "x-dlq-original-offset"
+)
+
+// ConsumerWorkerId is used as the worker id of failures that happen before a worker picks up the event
+const ConsumerWorkerId = -1
+
+var ErrDeadLetterDisabled = errors.New("dead letter topic is not configured")
+
+// Failure describes why a message could not be processed
+type Failure struct {
+	Stage    string
+	Err      error
+	WorkerId int
+}
+
+// DeadLetterEnabled reports whether a dead letter topic is configured
+func (p *Producer) DeadLetterEnabled() bool {
+	return p.deadLetterTopic != ""
+}
+
+// PublishDeadLetter sends the original message bytes and headers to the dead letter topic
+// along with headers describing the failure. The caller is responsible for marking the
+// original message once this returns without error.
+func (p *Producer) PublishDeadLetter(ctx context.Context, message *sarama.ConsumerMessage, failure Failure) error {
+	if !p.DeadLetterEnabled() {
+		return ErrDeadLetterDisabled
+	}
+	tr := otel.Tracer("hangout.storage.kafka")
+	ctx, span := tr.Start(ctx, "PublishDeadLetter", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination", p.deadLetterTopic),
+		attribute.String("dlq.stage", failure.Stage),
+		attribute.Int("worker.id", failure.WorkerId),
+	)
+
+	errorText := ""
+	if failure.Err != nil {
+		errorText = failure.Err.Error()
+	}
+	headers := copyHeaders(message.Headers)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerDLQStage), Value: []byte(failure.Stage)},
+		sarama.RecordHeader{Key: []byte(headerDLQError), Value: []byte(errorText)},
+		sarama.RecordHeader{Key: []byte(headerDLQAttempt), Value: []byte(strconv.Itoa(attemptOf(message)))},
+		sarama.RecordHeader{Key: []byte(headerDLQWorkerId), Value: []byte(strconv.Itoa(failure.WorkerId))},
+		sarama.RecordHeader{Key: []byte(headerDLQTraceId), Value: []byte(span.SpanContext().TraceID().String())},
+		sarama.RecordHeader{Key: []byte(headerDLQOriginalTopic), Value: []byte(message.Topic)},
+		sarama.RecordHeader{Key: []byte(headerDLQOriginalOffset), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+	)
+	record := &sarama.ProducerMessage{
+		Topic:   p.deadLetterTopic,
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	}
+	if message.Key != nil {
+		record.Key = sarama.ByteEncoder(message.Key)
+	}
+	partition, offset, err := p.producer.SendMessage(record)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		p.log.Error(ctx, "could not publish message to dead letter topic", "topic", p.deadLetterTopic, "error", err)
+		return err
+	}
+	p.log.Warn(ctx, "published message to dead letter topic",
+		"topic", p.deadLetterTopic,
+		"partition", partition,
+		"offset", offset,
+		"stage", failure.Stage,
+		"error", errorText,
+	)
+	return nil
+}
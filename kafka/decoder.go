@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/knadh/koanf/v2"
+)
+
+// Encodings of the upload event body selected by kafka.encoding
+const (
+	encodingJson     = "json"
+	encodingAvro     = "avro"
+	encodingProtobuf = "protobuf"
+)
+
+// confluentMagicByte starts every payload in the Confluent wire format, followed by a 4 byte schema id
+const confluentMagicByte = 0
+
+var ErrInvalidWireFormat = errors.New("payload is not in the confluent wire format")
+
+// Decoder turns the payload of an upload event into its body
+type Decoder interface {
+	Decode(ctx context.Context, payload []byte) (eventBody, error)
+}
+
+// newDecoder returns the decoder for the encoding configured in kafka.encoding. JSON is the default.
+func newDecoder(cfg *koanf.Koanf) (Decoder, error) {
+	encoding := strings.ToLower(cfg.String("kafka.encoding"))
+	if encoding == "" || encoding == encodingJson {
+		return jsonDecoder{}, nil
+	}
+	registry, err := newSchemaRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case encodingAvro:
+		return &registryDecoder{registry: registry, schemaType: schemaTypeAvro, compile: compileAvroSchema}, nil
+	case encodingProtobuf:
+		return &registryDecoder{registry: registry, schemaType: schemaTypeProtobuf, compile: compileProtobufSchema}, nil
+	default:
+		return nil, errors.New("unsupported kafka encoding: " + encoding)
+	}
+}
+
+// jsonDecoder decodes the plain JSON body
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(ctx context.Context, payload []byte) (eventBody, error) {
+	var body eventBody
+	err := json.Unmarshal(payload, &body)
+	return body, err
+}
+
+// recordDecoder decodes a schema encoded payload into its fields keyed by name
+type recordDecoder func(payload []byte) (map[string]any, error)
+
+// registryDecoder decodes Confluent wire format payloads using writer schemas from the registry.
+// Compiled schemas are cached by id.
+type registryDecoder struct {
+	registry   SchemaRegistry
+	schemaType string
+	compile    func(schema *Schema) (recordDecoder, error)
+	compiled   sync.Map
+}
+
+func (d *registryDecoder) Decode(ctx context.Context, payload []byte) (eventBody, error) {
+	if len(payload) < 5 || payload[0] != confluentMagicByte {
+		return eventBody{}, ErrInvalidWireFormat
+	}
+	id := int(binary.BigEndian.Uint32(payload[1:5]))
+	decode, err := d.decoderFor(ctx, id)
+	if err != nil {
+		return eventBody{}, err
+	}
+	record, err := decode(payload[5:])
+	if err != nil {
+		return eventBody{}, fmt.Errorf("could not decode payload with schema %d: %w", id, err)
+	}
+	return bodyFromRecord(record)
+}
+
+func (d *registryDecoder) decoderFor(ctx context.Context, id int) (recordDecoder, error) {
+	if cached, ok := d.compiled.Load(id); ok {
+		return cached.(recordDecoder), nil
+	}
+	schema, err := d.registry.SchemaById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type != d.schemaType {
+		return nil, fmt.Errorf("schema %d is %s, expected %s", id, schema.Type, d.schemaType)
+	}
+	decode, err := d.compile(schema)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile schema %d: %w", id, err)
+	}
+	d.compiled.Store(id, decode)
+	return decode, nil
+}
+
+// bodyFromRecord maps decoded fields onto the upload event body.
+// Names are matched ignoring case and underscores, so both contentType and content_type are accepted.
+func bodyFromRecord(record map[string]any) (eventBody, error) {
+	var body eventBody
+	for name, value := range record {
+		switch strings.ToLower(strings.ReplaceAll(name, "_", "")) {
+		case "version":
+			if value != nil {
+				body.Version = fmt.Sprint(value)
+			}
+		case "filename":
+			body.Filename, _ = value.(string)
+		case "contenttype":
+			body.ContentType, _ = value.(string)
+		case "profile":
+			body.Profile, _ = value.(string)
+		case "userid":
+			userId, ok := toInt64(value)
+			if !ok {
+				return body, fmt.Errorf("userId has unexpected type %T", value)
+			}
+			body.UserId = int32(userId)
+		}
+	}
+	return body, nil
+}
+
+func toInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case nil:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
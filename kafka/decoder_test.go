@@ -0,0 +1,399 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// registryWith writes the schemas to a file backed registry, keyed by the file name of each schema
+func registryWith(t *testing.T, schemas map[string]string) *fileSchemaRegistry {
+	t.Helper()
+	dir := t.TempDir()
+	for name, schema := range schemas {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(schema), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &fileSchemaRegistry{dir: dir}
+}
+
+// wire prefixes a payload with the confluent magic byte and the schema id
+func wire(id int, payload []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{confluentMagicByte}, uint32(id)), payload...)
+}
+
+// avroLong and avroString write the avro binary encoding of a long and a string
+func avroLong(b []byte, v int64) []byte {
+	return binary.AppendVarint(b, v)
+}
+
+func avroString(b []byte, s string) []byte {
+	return append(avroLong(b, int64(len(s))), s...)
+}
+
+const uploadAvro = `{
+	"type": "record", "name": "Upload", "namespace": "hangout.media",
+	"fields": [
+		{"name": "version", "type": "int"},
+		{"name": "userId", "type": "long"},
+		{"name": "filename", "type": "string"},
+		{"name": "content_type", "type": ["null", "string"]},
+		{"name": "profile", "type": ["null", "string"], "default": null},
+		{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["VIDEO", "IMAGE", "AUDIO"]}},
+		{"name": "origin", "type": {"type": "record", "name": "Origin", "fields": [
+			{"name": "device", "type": "string"},
+			{"name": "size", "type": {"type": "fixed", "name": "Size", "size": 2}}
+		]}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "labels", "type": {"type": "map", "values": "Kind"}}
+	]
+}`
+
+// uploadAvroPayload encodes a complete Upload record of uploadAvro
+func uploadAvroPayload() []byte {
+	b := avroLong(nil, 2)
+	b = avroLong(b, 42)
+	b = avroString(b, "clip.mp4")
+	b = avroString(avroLong(b, 1), "video/mp4")
+	b = avroLong(b, 0)
+	b = avroLong(b, 0)
+	b = append(avroString(b, "phone"), 0x01, 0x02)
+	// the tags in a block with a negative count and a byte size
+	b = avroLong(avroLong(b, -2), 4)
+	b = avroString(avroString(b, "a"), "b")
+	b = avroLong(b, 0)
+	b = avroLong(avroString(avroLong(b, 1), "cover"), 1)
+	return avroLong(b, 0)
+}
+
+func TestAvroDecoder(t *testing.T) {
+	complete := uploadAvroPayload()
+	tests := []struct {
+		name    string
+		payload []byte
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:    "nested record, union, enum, fixed, array and map",
+			payload: complete,
+			want: map[string]any{
+				"version": int32(2), "userId": int64(42), "filename": "clip.mp4",
+				"content_type": "video/mp4", "profile": nil, "kind": "VIDEO",
+				"origin": map[string]any{"device": "phone", "size": []byte{1, 2}},
+				"tags":   []any{"a", "b"}, "labels": map[string]any{"cover": "IMAGE"},
+			},
+		},
+		{name: "truncated", payload: complete[:len(complete)-3], wantErr: true},
+		{name: "empty", payload: nil, wantErr: true},
+		{name: "negative string length", payload: avroLong(avroLong(avroLong(nil, 2), 42), -5), wantErr: true},
+		{name: "string longer than the payload", payload: avroLong(avroLong(avroLong(nil, 2), 42), 1<<62), wantErr: true},
+		{name: "union branch out of range", payload: avroLong(avroString(avroLong(avroLong(nil, 2), 42), "clip.mp4"), 7), wantErr: true},
+		{name: "enum symbol out of range", payload: avroLong(avroLong(avroLong(avroString(avroLong(avroLong(nil, 2), 42), "clip.mp4"), 0), 0), 9), wantErr: true},
+	}
+	decode, err := compileAvroSchema(&Schema{Id: 1, Type: schemaTypeAvro, Schema: uploadAvro})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := decode(test.payload)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", record)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(record, test.want) {
+				t.Errorf("got %#v, want %#v", record, test.want)
+			}
+		})
+	}
+}
+
+func TestAvroHostileBlocks(t *testing.T) {
+	decode, err := compileAvroSchema(&Schema{Schema: `{"type": "record", "name": "R", "fields": [{"name": "tags", "type": {"type": "array", "items": "string"}}]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, payload := range map[string][]byte{
+		"huge block count":       avroLong(nil, 1<<60),
+		"most negative count":    avroLong(nil, -1<<63),
+		"block without its size": avroLong(nil, -1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if record, err := decode(payload); err == nil {
+				t.Errorf("expected an error, got %v", record)
+			}
+		})
+	}
+}
+
+func TestAvroSchemaErrors(t *testing.T) {
+	for name, schema := range map[string]string{
+		"not json":     `{"type": `,
+		"not a record": `"string"`,
+		"unknown type": `{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Missing"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileAvroSchema(&Schema{Schema: schema}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+const uploadProto = `
+syntax = "proto3";
+package hangout.media;
+
+/* the event the app publishes
+   for every upload */
+message Upload {
+	int32 version = 1;
+	int64 user_id = 2;
+	string filename = 3 [json_name = "filename"];
+	Kind kind = 4;
+	oneof source {
+		string content_type = 5;
+		bytes raw = 6;
+	}
+	repeated string tags = 7;
+	map<string, string> labels = 8;
+	Origin origin = 9;
+	sint32 offset = 10;
+	bool private = 11;
+	double ratio = 12;
+	fixed32 crc = 13;
+	reserved 14, 15;
+
+	enum Kind {
+		VIDEO = 0;
+		IMAGE = 1;
+	}
+	message Origin {
+		string device = 1;
+		message Location {
+			string city = 1;
+		}
+	}
+}
+
+// a second top level message, addressed through the message indexes
+message Deleted {
+	string filename = 1;
+	int32 user_id = 2;
+}
+`
+
+func TestProtobufDecoder(t *testing.T) {
+	upload := protowire.AppendTag(nil, 1, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, 2)
+	upload = protowire.AppendTag(upload, 2, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, 42)
+	upload = protowire.AppendTag(upload, 3, protowire.BytesType)
+	upload = protowire.AppendString(upload, "clip.mp4")
+	upload = protowire.AppendTag(upload, 4, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, 1)
+	upload = protowire.AppendTag(upload, 5, protowire.BytesType)
+	upload = protowire.AppendString(upload, "video/mp4")
+	upload = protowire.AppendTag(upload, 7, protowire.BytesType)
+	upload = protowire.AppendString(upload, "skipped")
+	upload = protowire.AppendTag(upload, 8, protowire.BytesType)
+	upload = protowire.AppendBytes(upload, []byte{0x0a, 0x01, 'k', 0x12, 0x01, 'v'})
+	upload = protowire.AppendTag(upload, 9, protowire.BytesType)
+	upload = protowire.AppendBytes(upload, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "phone"))
+	upload = protowire.AppendTag(upload, 10, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, protowire.EncodeZigZag(-3))
+	upload = protowire.AppendTag(upload, 11, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, 1)
+	upload = protowire.AppendTag(upload, 12, protowire.Fixed64Type)
+	upload = protowire.AppendFixed64(upload, 0x3ff8000000000000)
+	upload = protowire.AppendTag(upload, 13, protowire.Fixed32Type)
+	upload = protowire.AppendFixed32(upload, 7)
+	// a field the schema does not know
+	upload = protowire.AppendTag(upload, 99, protowire.VarintType)
+	upload = protowire.AppendVarint(upload, 1)
+
+	deleted := protowire.AppendTag(nil, 1, protowire.BytesType)
+	deleted = protowire.AppendString(deleted, "old.mp4")
+	deleted = protowire.AppendTag(deleted, 2, protowire.VarintType)
+	deleted = protowire.AppendVarint(deleted, 7)
+
+	location := protowire.AppendTag(nil, 1, protowire.BytesType)
+	location = protowire.AppendString(location, "Pune")
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:    "first message through the shorthand, enum, oneof and skipped fields",
+			payload: append([]byte{0}, upload...),
+			want: map[string]any{
+				"version": int32(2), "user_id": int64(42), "filename": "clip.mp4", "kind": int32(1),
+				"content_type": "video/mp4", "offset": int32(-3), "private": true, "ratio": 1.5, "crc": uint32(7),
+			},
+		},
+		{
+			name:    "first message through a full index path",
+			payload: append(binary.AppendVarint(binary.AppendVarint(nil, 1), 0), upload...),
+			want: map[string]any{
+				"version": int32(2), "user_id": int64(42), "filename": "clip.mp4", "kind": int32(1),
+				"content_type": "video/mp4", "offset": int32(-3), "private": true, "ratio": 1.5, "crc": uint32(7),
+			},
+		},
+		{
+			name:    "second top level message",
+			payload: append(binary.AppendVarint(binary.AppendVarint(nil, 1), 1), deleted...),
+			want:    map[string]any{"filename": "old.mp4", "user_id": int32(7)},
+		},
+		{
+			name:    "nested message",
+			payload: append(binary.AppendVarint(binary.AppendVarint(binary.AppendVarint(binary.AppendVarint(nil, 3), 0), 0), 0), location...),
+			want:    map[string]any{"city": "Pune"},
+		},
+		{name: "negative index count", payload: []byte{0x01}, wantErr: true},
+		{name: "index count beyond the payload", payload: binary.AppendVarint(nil, 1<<40), wantErr: true},
+		{name: "index out of range", payload: binary.AppendVarint(binary.AppendVarint(nil, 1), 5), wantErr: true},
+		{name: "negative index", payload: binary.AppendVarint(binary.AppendVarint(nil, 1), -1), wantErr: true},
+		{name: "missing indexes", payload: nil, wantErr: true},
+		{name: "truncated field", payload: append([]byte{0}, upload[:len(upload)-1]...), wantErr: true},
+		{name: "string longer than the payload", payload: []byte{0, 0x1a, 0xff, 0xff, 0x03, 'a'}, wantErr: true},
+	}
+	decode, err := compileProtobufSchema(&Schema{Id: 1, Type: schemaTypeProtobuf, Schema: uploadProto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := decode(test.payload)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", record)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(record, test.want) {
+				t.Errorf("got %#v, want %#v", record, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenizeProto(t *testing.T) {
+	got := tokenizeProto(`option (a.b) = "x\"y"; // comment
+	/* block */ map<string, int32> m = -1;`)
+	want := []string{"option", "(", "a.b", ")", "=", `"x\"y"`, ";", "map", "<", "string", ",", "int32", ">", "m", "=", "-1", ";"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// an unterminated comment or string must not run past the end
+	for _, source := range []string{`message A { /* open`, `message A { string a = "open`} {
+		tokenizeProto(source)
+	}
+}
+
+func TestProtobufSchemaErrors(t *testing.T) {
+	for name, schema := range map[string]string{
+		"no message":           `syntax = "proto3";`,
+		"unterminated message": `message A { string a = 1;`,
+		"missing brace":        `message A string a = 1; }`,
+		"invalid field number": `message A { string a = x; }`,
+		"missing equals":       `message A { string a 1; }`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileProtobufSchema(&Schema{Schema: schema}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRegistryDecoder(t *testing.T) {
+	registry := registryWith(t, map[string]string{"7.avsc": uploadAvro, "8.proto": uploadProto})
+	avro := &registryDecoder{registry: registry, schemaType: schemaTypeAvro, compile: compileAvroSchema}
+	body, err := avro.Decode(context.Background(), wire(7, uploadAvroPayload()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := eventBody{Version: "2", UserId: 42, Filename: "clip.mp4", ContentType: "video/mp4"}
+	if body != want {
+		t.Errorf("got %+v, want %+v", body, want)
+	}
+	for name, payload := range map[string][]byte{
+		"too short":            {0, 0, 0},
+		"wrong magic byte":     append([]byte{1}, wire(7, nil)[1:]...),
+		"schema of protobuf":   wire(8, nil),
+		"unknown schema":       wire(9, nil),
+		"corrupt after the id": wire(7, []byte{0x80}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := avro.Decode(context.Background(), payload); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := avro.Decode(context.Background(), wire(9, nil)); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("got %v, want %v", err, ErrSchemaNotFound)
+	}
+	if _, err := registry.SchemaById(context.Background(), 8); err != nil {
+		t.Errorf("could not read schema 8: %v", err)
+	}
+	if _, err := registry.SchemaById(context.Background(), 10); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("schema 10: got %v, want %v", err, ErrSchemaNotFound)
+	}
+}
+
+func TestHTTPSchemaRegistryErrors(t *testing.T) {
+	tests := []struct {
+		status      int
+		unavailable bool
+		notFound    bool
+	}{
+		{status: http.StatusServiceUnavailable, unavailable: true},
+		{status: http.StatusTooManyRequests, unavailable: true},
+		{status: http.StatusNotFound, notFound: true},
+		{status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			registry := &httpSchemaRegistry{baseUrl: server.URL, client: server.Client()}
+			_, err := registry.SchemaById(context.Background(), 1)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, ErrSchemaRegistryUnavailable) != test.unavailable || errors.Is(err, ErrSchemaNotFound) != test.notFound {
+				t.Errorf("status %d returned %v", test.status, err)
+			}
+		})
+	}
+	// a registry that can not be reached at all is unavailable as well
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	registry := &httpSchemaRegistry{baseUrl: server.URL, client: server.Client()}
+	if _, err := registry.SchemaById(context.Background(), 1); !errors.Is(err, ErrSchemaRegistryUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrSchemaRegistryUnavailable)
+	}
+}
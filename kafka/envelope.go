@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	// cloudEventsHeaderPrefix is used by the kafka protocol binding for attributes in binary content mode
+	cloudEventsHeaderPrefix = "ce_"
+	// defaultSchemaVersion is assumed for events that do not state a schema version
+	defaultSchemaVersion = "1"
+)
+
+// supportedSchemaVersions lists the versions of the upload event body this service understands
+var supportedSchemaVersions = map[string]bool{
+	"1": true,
+}
+
+var (
+	ErrUnsupportedEventVersion = errors.New("unsupported event version")
+	ErrInvalidEvent            = errors.New("invalid event")
+)
+
+// envelope is an upload event along with the metadata describing it
+type envelope struct {
+	body          eventBody
+	id            string
+	source        string
+	eventType     string
+	time          time.Time
+	schemaVersion string
+}
+
+// structuredCloudEvent is a CloudEvent in structured content mode with a JSON event format
+type structuredCloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	SchemaVersion   string          `json:"schemaversion,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// parseEnvelope decodes an upload event. It accepts CloudEvents 1.0 in binary content mode
+// (attributes in ce_* headers), in structured content mode (JSON envelope) and the legacy bare body.
+// The body itself is decoded with the configured decoder, except for JSON data inside a structured event.
+func parseEnvelope(ctx context.Context, message *sarama.ConsumerMessage, decoder Decoder) (*envelope, error) {
+	headers := kafkaHeaderCarrier(message.Headers)
+	if specVersion := headers.Get(cloudEventsHeaderPrefix + "specversion"); specVersion != "" {
+		return parseBinaryCloudEvent(ctx, message, headers, decoder)
+	}
+	if strings.HasPrefix(headers.Get("content-type"), cloudEventsContentType) || isStructuredCloudEvent(message.Value) {
+		return parseStructuredCloudEvent(ctx, message.Value, decoder)
+	}
+	return parseLegacyEvent(ctx, message, decoder)
+}
+
+func parseBinaryCloudEvent(ctx context.Context, message *sarama.ConsumerMessage, headers kafkaHeaderCarrier, decoder Decoder) (*envelope, error) {
+	e := &envelope{
+		id:            headers.Get(cloudEventsHeaderPrefix + "id"),
+		source:        headers.Get(cloudEventsHeaderPrefix + "source"),
+		eventType:     headers.Get(cloudEventsHeaderPrefix + "type"),
+		schemaVersion: headers.Get(cloudEventsHeaderPrefix + "schemaversion"),
+	}
+	err := checkCloudEvent(headers.Get(cloudEventsHeaderPrefix+"specversion"), e, headers.Get(cloudEventsHeaderPrefix+"time"))
+	if err != nil {
+		return nil, err
+	}
+	if e.body, err = decoder.Decode(ctx, message.Value); err != nil {
+		return nil, fmt.Errorf("%w: could not decode cloud event data: %w", ErrInvalidEvent, err)
+	}
+	return e, nil
+}
+
+func parseStructuredCloudEvent(ctx context.Context, value []byte, decoder Decoder) (*envelope, error) {
+	var event structuredCloudEvent
+	if err := json.Unmarshal(value, &event); err != nil {
+		return nil, fmt.Errorf("%w: could not decode cloud event: %s", ErrInvalidEvent, err.Error())
+	}
+	e := &envelope{id: event.Id, source: event.Source, eventType: event.Type, schemaVersion: event.SchemaVersion}
+	if err := checkCloudEvent(event.SpecVersion, e, event.Time); err != nil {
+		return nil, err
+	}
+	var err error
+	if event.DataBase64 != "" {
+		// binary data is encoded the same way as the record value of the other modes
+		data, decodeErr := base64.StdEncoding.DecodeString(event.DataBase64)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("%w: could not decode data_base64: %s", ErrInvalidEvent, decodeErr.Error())
+		}
+		e.body, err = decoder.Decode(ctx, data)
+	} else if len(event.Data) > 0 {
+		e.body, err = jsonDecoder{}.Decode(ctx, event.Data)
+	} else {
+		return nil, fmt.Errorf("%w: cloud event has no data", ErrInvalidEvent)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode cloud event data: %w", ErrInvalidEvent, err)
+	}
+	return e, nil
+}
+
+func parseLegacyEvent(ctx context.Context, message *sarama.ConsumerMessage, decoder Decoder) (*envelope, error) {
+	e := &envelope{
+		id:        message.Topic + "-" + strconv.Itoa(int(message.Partition)) + "-" + strconv.FormatInt(message.Offset, 10),
+		source:    "kafka://" + message.Topic,
+		eventType: "legacy",
+		time:      message.Timestamp,
+	}
+	var err error
+	if e.body, err = decoder.Decode(ctx, message.Value); err != nil {
+		return nil, err
+	}
+	e.schemaVersion = e.body.Version
+	if err := checkSchemaVersion(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// checkCloudEvent validates the required context attributes and fills in the time and schema version
+func checkCloudEvent(specVersion string, e *envelope, eventTime string) error {
+	if specVersion != cloudEventsSpecVersion {
+		return fmt.Errorf("%w: cloud events specversion %q, expected %q", ErrUnsupportedEventVersion, specVersion, cloudEventsSpecVersion)
+	}
+	if e.id == "" || e.source == "" || e.eventType == "" {
+		return fmt.Errorf("%w: cloud event is missing one of the required attributes id, source or type", ErrInvalidEvent)
+	}
+	if eventTime != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, eventTime)
+		if err != nil {
+			return fmt.Errorf("%w: cloud event time %q is not RFC 3339", ErrInvalidEvent, eventTime)
+		}
+		e.time = parsed
+	}
+	return checkSchemaVersion(e)
+}
+
+func checkSchemaVersion(e *envelope) error {
+	if e.schemaVersion == "" {
+		e.schemaVersion = defaultSchemaVersion
+	}
+	if !supportedSchemaVersions[e.schemaVersion] {
+		return fmt.Errorf("%w: schema version %q", ErrUnsupportedEventVersion, e.schemaVersion)
+	}
+	return nil
+}
+
+// isStructuredCloudEvent checks for the specversion attribute that every structured cloud event carries
+func isStructuredCloudEvent(value []byte) bool {
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !bytes.Contains(trimmed, []byte(`"specversion"`)) {
+		return false
+	}
+	var probe struct {
+		SpecVersion *string `json:"specversion"`
+	}
+	return json.Unmarshal(value, &probe) == nil && probe.SpecVersion != nil
+}
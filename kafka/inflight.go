@@ -0,0 +1,227 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"hangout.com/core/storage-service/logger"
+)
+
+// ErrPartitionRevoked is the cancellation cause of jobs whose partition was taken away during a rebalance
+var ErrPartitionRevoked = errors.New("partition revoked during rebalance")
+
+// abandonGracePeriod is how long cleanup waits for cancelled jobs to stop
+const abandonGracePeriod = 10 * time.Second
+
+// inflightJob tracks a file event from the moment it is consumed until a worker is done with it.
+// It implements files.Lease.
+type inflightJob struct {
+	topic     string
+	partition int32
+	offset    int64
+	filename  string
+	session   sarama.ConsumerGroupSession
+	cancel    context.CancelCauseFunc
+	tracker   *inflightTracker
+	done      chan struct{}
+	mu        sync.Mutex
+	started   bool
+	revoked   bool
+	finished  bool
+	// acknowledged is guarded by the mutex of the tracker
+	acknowledged bool
+}
+
+// Start is called by the worker before it starts processing. It returns false when the
+// partition was revoked while the event was waiting in the channel.
+func (job *inflightJob) Start() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.revoked {
+		return false
+	}
+	job.started = true
+	return true
+}
+
+// Finish is called by the worker once it stops working on the event, whatever the outcome
+func (job *inflightJob) Finish() {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.finished {
+		return
+	}
+	job.finished = true
+	close(job.done)
+	job.tracker.remove(job)
+}
+
+// Acknowledge marks the event as consumed. Its offset is only committed once every earlier event
+// of the partition has been acknowledged too, so that a failed or abandoned event is never skipped.
+func (job *inflightJob) Acknowledge() {
+	job.tracker.acknowledge(job)
+}
+
+// revoke cancels the job and reports whether it had already started
+func (job *inflightJob) revoke() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.revoked = true
+	job.cancel(ErrPartitionRevoked)
+	return job.started
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// inflightTracker knows every event of the current session that has not been finished yet, and
+// every event of a partition from the first one that has not been acknowledged yet
+type inflightTracker struct {
+	mu   sync.Mutex
+	jobs map[*inflightJob]struct{}
+	// pending holds the events of each partition in offset order, starting at the lowest unacknowledged one
+	pending map[topicPartition][]*inflightJob
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{jobs: map[*inflightJob]struct{}{}, pending: map[topicPartition][]*inflightJob{}}
+}
+
+// track registers a consumed message. Every message of the session has to be tracked, otherwise its offset
+// is never committed. The returned context is cancelled when the partition is revoked.
+func (t *inflightTracker) track(ctx context.Context, session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) (context.Context, *inflightJob) {
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	job := &inflightJob{
+		topic:     message.Topic,
+		partition: message.Partition,
+		offset:    message.Offset,
+		session:   session,
+		cancel:    cancel,
+		tracker:   t,
+		done:      make(chan struct{}),
+	}
+	key := topicPartition{message.Topic, message.Partition}
+	t.mu.Lock()
+	t.jobs[job] = struct{}{}
+	t.pending[key] = append(t.pending[key], job)
+	t.mu.Unlock()
+	return jobCtx, job
+}
+
+// acknowledge commits the offset after the highest event of the partition up to which every event
+// has been acknowledged. Marking a later offset directly would commit past the events before it.
+func (t *inflightTracker) acknowledge(job *inflightJob) {
+	key := topicPartition{job.topic, job.partition}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job.acknowledged = true
+	pending := t.pending[key]
+	contiguous := 0
+	for contiguous < len(pending) && pending[contiguous].acknowledged {
+		contiguous++
+	}
+	if contiguous == 0 {
+		return
+	}
+	last := pending[contiguous-1]
+	last.session.MarkOffset(last.topic, last.partition, last.offset+1, "")
+	t.pending[key] = pending[contiguous:]
+}
+
+func (t *inflightTracker) remove(job *inflightJob) {
+	t.mu.Lock()
+	delete(t.jobs, job)
+	t.mu.Unlock()
+}
+
+func (t *inflightTracker) reset() {
+	t.mu.Lock()
+	t.pending = map[topicPartition][]*inflightJob{}
+	t.mu.Unlock()
+}
+
+func (t *inflightTracker) snapshot() []*inflightJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]*inflightJob, 0, len(t.jobs))
+	for job := range t.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// drain runs when the partitions of the session are revoked. Events that are still waiting in the
+// channel are released straight away, running jobs get until the timeout to finish. Jobs that are still
+// running after that are cancelled and recorded as abandoned. Released and abandoned events are never
+// acknowledged, so no offset at or after theirs is committed and the new owner of the partition receives
+// them again.
+func (t *inflightTracker) drain(ctx context.Context, timeout time.Duration, log logger.Log) {
+	// the next session starts with whatever offsets were committed, events acknowledged after this are ignored
+	defer t.reset()
+	var running []*inflightJob
+	for _, job := range t.snapshot() {
+		job.mu.Lock()
+		started := job.started
+		job.mu.Unlock()
+		if started {
+			running = append(running, job)
+			continue
+		}
+		job.revoke()
+		t.remove(job)
+		log.Debug(ctx, "released queued event of revoked partition", "topic", job.topic, "partition", job.partition, "offset", job.offset, "file", job.filename)
+	}
+	if len(running) == 0 {
+		return
+	}
+	log.Info(ctx, "waiting for in-flight jobs to finish before giving up partitions", "jobs", len(running), "timeout", timeout.String())
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var abandoned []*inflightJob
+	for i, job := range running {
+		select {
+		case <-job.done:
+			continue
+		case <-deadline.C:
+			abandoned = append(abandoned, running[i:]...)
+		}
+		break
+	}
+	if len(abandoned) == 0 {
+		log.Info(ctx, "all in-flight jobs finished")
+		return
+	}
+	grace := time.NewTimer(abandonGracePeriod)
+	defer grace.Stop()
+	for _, job := range abandoned {
+		if !job.revoke() {
+			continue
+		}
+		attrs := metric.WithAttributes(
+			attribute.String("messaging.destination", job.topic),
+			attribute.Int64("messaging.kafka.partition", int64(job.partition)),
+		)
+		abandonedJobsCounter.Add(ctx, 1, attrs)
+		log.Warn(ctx, "abandoned in-flight job of revoked partition",
+			"topic", job.topic,
+			"partition", job.partition,
+			"offset", job.offset,
+			"file", job.filename,
+		)
+	}
+	for _, job := range abandoned {
+		select {
+		case <-job.done:
+		case <-grace.C:
+			log.Error(ctx, "abandoned jobs did not stop in time", "grace-period", abandonGracePeriod.String())
+			return
+		}
+	}
+}
@@ -2,6 +2,9 @@ package kafka
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/knadh/koanf/v2"
@@ -14,7 +17,7 @@ import (
 // This implements Sarama consumer group API
 // Supports multi instance. All instances will join same consumer group.
 // Single consumer per instance
-func StartConsumer(eventChan chan<- *files.File, ctx context.Context, cfg *koanf.Koanf, log logger.Log) error {
+func StartConsumer(eventChan chan<- *files.File, producer *Producer, ctx context.Context, cfg *koanf.Koanf, log logger.Log) error {
 	log.Info(ctx, "starting kafka consumer")
 	log.Debug(ctx, "Configuring kafka client")
 	consumerGroup, err := configureKafka(cfg)
@@ -23,32 +26,105 @@ func StartConsumer(eventChan chan<- *files.File, ctx context.Context, cfg *koanf
 		return err
 	}
 
-	log.Debug(ctx, "configured kafka consumer group")
+	decoder, err := newDecoder(cfg)
+	if err != nil {
+		exceptions.KafkaConnectError(ctx, "could not setup upload event decoder", &err, log)
+		return err
+	}
+	log.Debug(ctx, "configured kafka consumer group", "encoding", cfg.String("kafka.encoding"))
 	log.Info(ctx, "trying to connect to kafka")
-	go consume(eventChan, consumerGroup, ctx, cfg, log)
+	go consume(eventChan, consumerGroup, producer, decoder, ctx, cfg, log)
 	return nil
 }
-func configureKafka(cfg *koanf.Koanf) (sarama.ConsumerGroup, error) {
+
+// newSaramaConfig builds the client configuration shared by the consumer group and the producer
+func newSaramaConfig(cfg *koanf.Koanf) (*sarama.Config, error) {
 	kafkaConfig := sarama.NewConfig()
 	kafkaConfig.Version = sarama.DefaultVersion
-	kafkaConfig.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRange()
+	kafkaConfig.ClientID = cfg.String("application.name")
+	if err := configureTLS(kafkaConfig, cfg); err != nil {
+		return nil, err
+	}
+	if err := configureSASL(kafkaConfig, cfg); err != nil {
+		return nil, err
+	}
+	return kafkaConfig, nil
+}
+
+// brokers returns the bootstrap servers. kafka.brokers takes a list, kafka.url a comma separated string.
+// Both can be comma separated when they are set through env variables.
+func brokers(cfg *koanf.Koanf) []string {
+	configured := cfg.Strings("kafka.brokers")
+	if len(configured) == 0 {
+		configured = []string{cfg.String("kafka.url")}
+	}
+	var addresses []string
+	for _, entry := range configured {
+		for _, address := range strings.Split(entry, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
+
+func configureKafka(cfg *koanf.Koanf) (sarama.ConsumerGroup, error) {
+	kafkaConfig, err := newSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := rebalanceStrategy(cfg.String("kafka.rebalance.strategy"))
+	if err != nil {
+		return nil, err
+	}
+	kafkaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{strategy}
 	kafkaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
-	brokers := []string{cfg.String("kafka.url")}
-	return sarama.NewConsumerGroup(brokers, cfg.String("kafka.group-id"), kafkaConfig)
+	return sarama.NewConsumerGroup(brokers(cfg), cfg.String("kafka.group-id"), kafkaConfig)
+}
+
+// rebalanceStrategy returns the partition assignor configured in kafka.rebalance.strategy.
+// Sarama only speaks the eager rebalance protocol, every rebalance revokes all partitions of the instance.
+// The sticky assignor hands most of them back to their previous owner, and in-flight jobs are drained on revoke.
+// The cooperative protocol is not supported, so cooperative-sticky is rejected instead of quietly running eager.
+func rebalanceStrategy(name string) (sarama.BalanceStrategy, error) {
+	switch strings.ToLower(name) {
+	case "", "sticky":
+		return sarama.NewBalanceStrategySticky(), nil
+	case "range":
+		return sarama.NewBalanceStrategyRange(), nil
+	case "roundrobin", "round-robin":
+		return sarama.NewBalanceStrategyRoundRobin(), nil
+	default:
+		return nil, errors.New("unsupported kafka rebalance strategy: " + name)
+	}
 }
 
-func consume(eventChan chan<- *files.File, consumerGroup sarama.ConsumerGroup, ctx context.Context, cfg *koanf.Koanf, log logger.Log) {
+func consume(eventChan chan<- *files.File, consumerGroup sarama.ConsumerGroup, producer *Producer, decoder Decoder, ctx context.Context, cfg *koanf.Koanf, log logger.Log) {
 	defer close(eventChan) // Close the channel when done
 	defer consumerGroup.Close()
 
-	handler := &ConsumerGroupHandler{Files: eventChan, ctx: ctx, log: log}
+	drainTimeout := cfg.Duration("kafka.rebalance.drain-timeout")
+	if drainTimeout <= 0 {
+		drainTimeout = 30 * time.Second
+	}
+	handler := &ConsumerGroupHandler{
+		Files:        eventChan,
+		partitions:   consumerGroup,
+		producer:     producer,
+		decoder:      decoder,
+		inflight:     newInflightTracker(),
+		drainTimeout: drainTimeout,
+		ctx:          ctx,
+		log:          log,
+	}
 	for {
 		select {
 		case <-ctx.Done(): // Exit if the context is canceled
 			log.Info(ctx, "Context cancelled, stopping consumer")
 			return
 		default:
-			if err := consumerGroup.Consume(ctx, []string{cfg.String("kafka.topic")}, handler); err != nil {
+			if err := consumerGroup.Consume(ctx, topics(cfg), handler); err != nil {
 				exceptions.KafkaConsumerError(ctx, "Error in consumer loop", &err, log)
 				return
 			}
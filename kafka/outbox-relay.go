@@ -0,0 +1,162 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"hangout.com/core/storage-service/database"
+	"hangout.com/core/storage-service/logger"
+)
+
+// OutboxRelay publishes the events written to the outbox table to kafka.
+// Delivery is at least once, a record may be published again if the relay stops before marking it as sent.
+type OutboxRelay struct {
+	producer     *Producer
+	dbConnPool   *database.DatabaseConnectionPool
+	pollInterval time.Duration
+	batchSize    int
+	claimTimeout time.Duration
+	wg           *sync.WaitGroup
+	log          logger.Log
+}
+
+// StartOutboxRelay starts relaying outbox records in the background until the context is cancelled
+func StartOutboxRelay(ctx context.Context, producer *Producer, dbConnPool *database.DatabaseConnectionPool, cfg *koanf.Koanf, log logger.Log) *OutboxRelay {
+	relay := &OutboxRelay{
+		producer:     producer,
+		dbConnPool:   dbConnPool,
+		pollInterval: cfg.Duration("kafka.outbox.poll-interval"),
+		batchSize:    cfg.Int("kafka.outbox.batch-size"),
+		claimTimeout: cfg.Duration("kafka.outbox.claim-timeout"),
+		wg:           &sync.WaitGroup{},
+		log:          log.With("component", "outbox-relay"),
+	}
+	if relay.pollInterval <= 0 {
+		relay.pollInterval = time.Second
+	}
+	if relay.batchSize <= 0 {
+		relay.batchSize = 100
+	}
+	if relay.claimTimeout <= 0 {
+		relay.claimTimeout = time.Minute
+	}
+	relay.log.Info(ctx, "starting outbox relay", "poll-interval", relay.pollInterval.String(), "batch-size", relay.batchSize, "claim-timeout", relay.claimTimeout.String())
+	relay.wg.Add(1)
+	go relay.run(ctx)
+	return relay
+}
+
+func (relay *OutboxRelay) run(ctx context.Context) {
+	defer relay.wg.Done()
+	ticker := time.NewTicker(relay.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			relay.log.Info(ctx, "Context cancelled, stopping outbox relay")
+			return
+		case <-ticker.C:
+			relay.drain(ctx)
+		}
+	}
+}
+
+// drain relays batches until the outbox has no pending records or publishing fails
+func (relay *OutboxRelay) drain(ctx context.Context) {
+	for {
+		sent, err := relay.relay(ctx)
+		if err != nil {
+			relay.log.Error(ctx, "could not relay outbox records", "sent", sent, "error", err)
+			return
+		}
+		if sent > 0 {
+			relay.log.Debug(ctx, "relayed outbox records", "sent", sent)
+		}
+		if sent < relay.batchSize {
+			return
+		}
+	}
+}
+
+// relay claims a batch of records, publishes them in insertion order and marks the published ones as sent.
+// It stops at the first record that could not be published, so that records are never reordered, and
+// releases the claim on the rest. Returns the number of records marked as sent.
+func (relay *OutboxRelay) relay(ctx context.Context) (int, error) {
+	claimed, err := relay.dbConnPool.ClaimOutbox(ctx, relay.batchSize, relay.claimTimeout)
+	if err != nil {
+		return 0, err
+	}
+	sent := make([]int64, 0, len(claimed))
+	var publishErr error
+	for _, message := range claimed {
+		if publishErr = relay.publish(ctx, message); publishErr != nil {
+			break
+		}
+		sent = append(sent, message.Id)
+	}
+	if len(sent) > 0 {
+		if err = relay.dbConnPool.MarkOutboxSent(ctx, sent); err != nil {
+			// the claim runs out and the records are published again, delivery is at least once
+			return 0, err
+		}
+	}
+	if publishErr != nil {
+		unsent := make([]int64, 0, len(claimed)-len(sent))
+		for _, message := range claimed[len(sent):] {
+			unsent = append(unsent, message.Id)
+		}
+		if err = relay.dbConnPool.ReleaseOutbox(ctx, unsent); err != nil {
+			relay.log.Warn(ctx, "could not release outbox records, they are picked up again once the claim runs out", "error", err)
+		}
+		return len(sent), publishErr
+	}
+	return len(sent), nil
+}
+
+// publish produces a single outbox record. The trace stored with the record is continued
+// so that the status change and its event show up in the same trace.
+func (relay *OutboxRelay) publish(ctx context.Context, message database.OutboxMessage) error {
+	propagator := otel.GetTextMapPropagator()
+	parentCtx := propagator.Extract(ctx, propagation.MapCarrier(message.Headers))
+	tr := otel.Tracer("hangout.storage.kafka")
+	parentCtx, span := tr.Start(parentCtx, "PublishOutboxRecord", trace.WithSpanKind(trace.SpanKindProducer), trace.WithLinks(trace.LinkFromContext(ctx)))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination", message.Topic),
+		attribute.Int64("outbox.id", message.Id),
+	)
+
+	headers := make(kafkaProducerHeaderCarrier, 0, len(message.Headers))
+	for key, value := range message.Headers {
+		headers.Set(key, value)
+	}
+	propagator.Inject(parentCtx, &headers)
+	record := &sarama.ProducerMessage{
+		Topic:   message.Topic,
+		Key:     sarama.StringEncoder(message.Key),
+		Value:   sarama.ByteEncoder(message.Payload),
+		Headers: headers,
+	}
+	partition, offset, err := relay.producer.Send(record)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	relay.log.Debug(parentCtx, "published outbox record", "topic", message.Topic, "partition", partition, "offset", offset, "outbox-id", message.Id)
+	return nil
+}
+
+// Wait blocks until the relay has stopped
+func (relay *OutboxRelay) Wait() {
+	relay.wg.Wait()
+}
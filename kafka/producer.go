@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"github.com/knadh/koanf/v2"
+	"hangout.com/core/storage-service/logger"
+)
+
+// Producer publishes records that the service emits back to kafka
+type Producer struct {
+	producer        sarama.SyncProducer
+	deadLetterTopic string
+	retryTiers      []retryTier
+	log             logger.Log
+}
+
+// NewProducer creates a synchronous producer using the same broker configuration as the consumer
+func NewProducer(ctx context.Context, cfg *koanf.Koanf, log logger.Log) (*Producer, error) {
+	log.Debug(ctx, "configuring kafka producer")
+	kafkaConfig, err := newSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	kafkaConfig.Producer.Return.Successes = true
+	kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	kafkaConfig.Producer.Retry.Max = 5
+	producer, err := sarama.NewSyncProducer(brokers(cfg), kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	tiers := retryTiers(cfg)
+	log.Info(ctx, "configured kafka producer",
+		"dlq-topic", cfg.String("kafka.dlq-topic"),
+		"retry-tiers", len(tiers),
+	)
+	return &Producer{
+		producer:        producer,
+		deadLetterTopic: cfg.String("kafka.dlq-topic"),
+		retryTiers:      tiers,
+		log:             log,
+	}, nil
+}
+
+// Send publishes a record and waits until every in-sync replica has it
+func (p *Producer) Send(record *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	return p.producer.SendMessage(record)
+}
+
+// Close flushes and shuts down the underlying producer
+func (p *Producer) Close(ctx context.Context) {
+	if err := p.producer.Close(); err != nil {
+		p.log.Error(ctx, "could not close kafka producer", "error", err)
+		return
+	}
+	p.log.Info(ctx, "closed kafka producer")
+}
+
+// attemptOf returns how many times the message has been tried so far, counting the current try
+func attemptOf(message *sarama.ConsumerMessage) int {
+	value := kafkaHeaderCarrier(message.Headers).Get(headerAttempt)
+	attempt, err := strconv.Atoi(value)
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+// copyHeaders converts consumed headers so they can be attached to a produced record
+func copyHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	copied := make([]sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		copied = append(copied, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return copied
+}
@@ -0,0 +1,389 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMessage is a message declaration of a .proto schema
+type protoMessage struct {
+	name     string
+	fields   map[protowire.Number]protoField
+	messages []*protoMessage
+}
+
+type protoField struct {
+	name     string
+	typ      string
+	repeated bool
+}
+
+// compileProtobufSchema parses the .proto writer schema of a protobuf encoded upload event.
+// Only scalar fields are decoded, fields of message and map types are skipped.
+func compileProtobufSchema(schema *Schema) (recordDecoder, error) {
+	messages, enums, err := parseProto(schema.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("protobuf schema declares no message")
+	}
+	return func(payload []byte) (map[string]any, error) {
+		indexes, n, err := readMessageIndexes(payload)
+		if err != nil {
+			return nil, err
+		}
+		message, err := messageAt(messages, indexes)
+		if err != nil {
+			return nil, err
+		}
+		return decodeProtoMessage(message, enums, payload[n:])
+	}, nil
+}
+
+// readMessageIndexes reads the path to the message type that follows the schema id in the Confluent
+// wire format. It is a zigzag varint count followed by that many zigzag varint indexes,
+// where a single 0 byte is a shorthand for the first message.
+func readMessageIndexes(payload []byte) ([]int, int, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if count == 0 {
+		return []int{0}, n, nil
+	}
+	// every index takes at least a byte, a count the payload can not hold comes from a corrupt or hostile message
+	if count < 0 || count > int64(len(payload)-n) {
+		return nil, 0, fmt.Errorf("invalid message index count %d", count)
+	}
+	indexes := make([]int, 0, count)
+	for i := int64(0); i < count; i++ {
+		index, m := binary.Varint(payload[n:])
+		if m <= 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		indexes = append(indexes, int(index))
+		n += m
+	}
+	return indexes, n, nil
+}
+
+func messageAt(messages []*protoMessage, indexes []int) (*protoMessage, error) {
+	var message *protoMessage
+	for _, index := range indexes {
+		if index < 0 || index >= len(messages) {
+			return nil, fmt.Errorf("message index %d out of range", index)
+		}
+		message = messages[index]
+		messages = message.messages
+	}
+	return message, nil
+}
+
+func decodeProtoMessage(message *protoMessage, enums map[string]bool, payload []byte) (map[string]any, error) {
+	record := map[string]any{}
+	for len(payload) > 0 {
+		number, wireType, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		payload = payload[n:]
+		field, known := message.fields[number]
+		if !known || field.repeated {
+			n = protowire.ConsumeFieldValue(number, wireType, payload)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			payload = payload[n:]
+			continue
+		}
+		var value any
+		switch wireType {
+		case protowire.VarintType:
+			v, m := protowire.ConsumeVarint(payload)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			n = m
+			switch field.typ {
+			case "int32", "enum":
+				value = int32(v)
+			case "sint32":
+				value = int32(protowire.DecodeZigZag(v & math.MaxUint32))
+			case "sint64":
+				value = protowire.DecodeZigZag(v)
+			case "uint32":
+				value = uint32(v)
+			case "uint64":
+				value = v
+			case "bool":
+				value = protowire.DecodeBool(v)
+			default:
+				if enums[field.typ] {
+					value = int32(v)
+				} else {
+					value = int64(v)
+				}
+			}
+		case protowire.Fixed32Type:
+			v, m := protowire.ConsumeFixed32(payload)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			n = m
+			switch field.typ {
+			case "float":
+				value = math.Float32frombits(v)
+			case "sfixed32":
+				value = int32(v)
+			default:
+				value = v
+			}
+		case protowire.Fixed64Type:
+			v, m := protowire.ConsumeFixed64(payload)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			n = m
+			switch field.typ {
+			case "double":
+				value = math.Float64frombits(v)
+			case "sfixed64":
+				value = int64(v)
+			default:
+				value = v
+			}
+		case protowire.BytesType:
+			v, m := protowire.ConsumeBytes(payload)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			n = m
+			switch field.typ {
+			case "string":
+				value = string(v)
+			case "bytes":
+				value = v
+			default:
+				// nested messages and maps are not part of the upload event
+				payload = payload[n:]
+				continue
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, payload)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			payload = payload[n:]
+			continue
+		}
+		record[field.name] = value
+		payload = payload[n:]
+	}
+	return record, nil
+}
+
+// parseProto reads the message declarations and enum names of a .proto file.
+// It understands the subset of the language needed for flat event schemas.
+func parseProto(source string) ([]*protoMessage, map[string]bool, error) {
+	p := &protoParser{tokens: tokenizeProto(source), enums: map[string]bool{}}
+	var messages []*protoMessage
+	for !p.done() {
+		switch p.peek() {
+		case "message":
+			message, err := p.message()
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, message)
+		case "enum":
+			p.next()
+			p.enums[p.next()] = true
+			p.skipBlock()
+		case "service", "extend":
+			p.next()
+			p.next()
+			p.skipBlock()
+		default:
+			p.skipStatement()
+		}
+	}
+	return messages, p.enums, nil
+}
+
+type protoParser struct {
+	tokens []string
+	pos    int
+	enums  map[string]bool
+}
+
+func (p *protoParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *protoParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// skipStatement skips everything up to and including the next semicolon
+func (p *protoParser) skipStatement() {
+	for !p.done() && p.next() != ";" {
+	}
+}
+
+// skipBlock skips a braced block, the current token has to be the opening brace
+func (p *protoParser) skipBlock() {
+	depth := 0
+	for !p.done() {
+		switch p.next() {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (p *protoParser) message() (*protoMessage, error) {
+	p.next() // message
+	message := &protoMessage{name: p.next(), fields: map[protowire.Number]protoField{}}
+	if p.next() != "{" {
+		return nil, errors.New("expected { after message " + message.name)
+	}
+	return message, p.body(message)
+}
+
+// body parses the declarations of a message or oneof until the closing brace
+func (p *protoParser) body(message *protoMessage) error {
+	for !p.done() {
+		switch p.peek() {
+		case "}":
+			p.next()
+			return nil
+		case "message":
+			nested, err := p.message()
+			if err != nil {
+				return err
+			}
+			message.messages = append(message.messages, nested)
+		case "enum":
+			p.next()
+			p.enums[p.next()] = true
+			p.skipBlock()
+		case "oneof":
+			p.next()
+			p.next()
+			if p.next() != "{" {
+				return errors.New("expected { after oneof in message " + message.name)
+			}
+			if err := p.body(message); err != nil {
+				return err
+			}
+		case "option", "reserved", "extensions", ";":
+			p.skipStatement()
+		default:
+			if err := p.field(message); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.New("unterminated message " + message.name)
+}
+
+func (p *protoParser) field(message *protoMessage) error {
+	field := protoField{}
+	switch p.peek() {
+	case "repeated":
+		field.repeated = true
+		p.next()
+	case "optional", "required":
+		p.next()
+	}
+	field.typ = p.next()
+	if field.typ == "map" {
+		// map<key, value> is encoded as a repeated message
+		for !p.done() && p.next() != ">" {
+		}
+		field.typ = "map"
+		field.repeated = true
+	}
+	field.name = p.next()
+	if p.next() != "=" {
+		return fmt.Errorf("expected = after field %s in message %s", field.name, message.name)
+	}
+	number, err := strconv.Atoi(p.next())
+	if err != nil {
+		return fmt.Errorf("invalid number of field %s in message %s", field.name, message.name)
+	}
+	if short := field.typ[strings.LastIndex(field.typ, ".")+1:]; p.enums[short] {
+		field.typ = "enum"
+	}
+	message.fields[protowire.Number(number)] = field
+	p.skipStatement()
+	return nil
+}
+
+// tokenizeProto splits a .proto file into identifiers, numbers, strings and punctuation, dropping comments
+func tokenizeProto(source string) []string {
+	var tokens []string
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i += 2
+			for i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if i > len(runes) {
+				i = len(runes)
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens
+}
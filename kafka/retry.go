@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/knadh/koanf/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers attached to every record published to a retry topic
+const (
+	headerRetryNotBefore     = "x-retry-not-before"
+	headerRetryOriginalTopic = "x-retry-original-topic"
+	headerRetryStage         = "x-retry-stage"
+	headerRetryError         = "x-retry-error"
+)
+
+// retryTier is a topic whose records are not consumed before the delay has passed
+type retryTier struct {
+	topic string
+	delay time.Duration
+}
+
+// retryTiers reads the ordered list of retry topics from the configuration
+func retryTiers(cfg *koanf.Koanf) []retryTier {
+	var tiers []retryTier
+	for _, tier := range cfg.Slices("kafka.retry.tiers") {
+		if tier.String("topic") == "" {
+			continue
+		}
+		tiers = append(tiers, retryTier{topic: tier.String("topic"), delay: tier.Duration("delay")})
+	}
+	return tiers
+}
+
+// topics returns the upload topic followed by every retry topic
+func topics(cfg *koanf.Koanf) []string {
+	names := []string{cfg.String("kafka.topic")}
+	for _, tier := range retryTiers(cfg) {
+		names = append(names, tier.topic)
+	}
+	return names
+}
+
+// Retry schedules the message on the next retry tier based on the attempt counter in its headers.
+// When every tier has been used up the message goes to the dead letter topic instead.
+// The caller is responsible for marking the original message once this returns without error.
+func (p *Producer) Retry(ctx context.Context, message *sarama.ConsumerMessage, failure Failure) error {
+	attempt := attemptOf(message)
+	if attempt > len(p.retryTiers) {
+		p.log.Warn(ctx, "retries exhausted, moving message to dead letter topic", "attempt", attempt, "stage", failure.Stage)
+		return p.PublishDeadLetter(ctx, message, failure)
+	}
+	tier := p.retryTiers[attempt-1]
+
+	tr := otel.Tracer("hangout.storage.kafka")
+	ctx, span := tr.Start(ctx, "PublishRetry", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination", tier.topic),
+		attribute.String("retry.stage", failure.Stage),
+		attribute.Int("retry.attempt", attempt),
+	)
+
+	originalTopic := kafkaHeaderCarrier(message.Headers).Get(headerRetryOriginalTopic)
+	if originalTopic == "" {
+		originalTopic = message.Topic
+	}
+	errorText := ""
+	if failure.Err != nil {
+		errorText = failure.Err.Error()
+	}
+	notBefore := time.Now().Add(tier.delay)
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+5)
+	for _, h := range copyHeaders(message.Headers) {
+		switch string(h.Key) {
+		case headerAttempt, headerRetryNotBefore, headerRetryOriginalTopic, headerRetryStage, headerRetryError:
+			continue
+		}
+		headers = append(headers, h)
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerAttempt), Value: []byte(strconv.Itoa(attempt + 1))},
+		sarama.RecordHeader{Key: []byte(headerRetryNotBefore), Value: []byte(strconv.FormatInt(notBefore.UnixMilli(), 10))},
+		sarama.RecordHeader{Key: []byte(headerRetryOriginalTopic), Value: []byte(originalTopic)},
+		sarama.RecordHeader{Key: []byte(headerRetryStage), Value: []byte(failure.Stage)},
+		sarama.RecordHeader{Key: []byte(headerRetryError), Value: []byte(errorText)},
+	)
+	record := &sarama.ProducerMessage{
+		Topic:   tier.topic,
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	}
+	if message.Key != nil {
+		record.Key = sarama.ByteEncoder(message.Key)
+	}
+	partition, offset, err := p.producer.SendMessage(record)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		p.log.Error(ctx, "could not publish message to retry topic", "topic", tier.topic, "error", err)
+		return err
+	}
+	p.log.Warn(ctx, "scheduled message for retry",
+		"topic", tier.topic,
+		"partition", partition,
+		"offset", offset,
+		"attempt", attempt,
+		"not-before", notBefore.Format(time.RFC3339),
+		"stage", failure.Stage,
+		"error", errorText,
+	)
+	return nil
+}
+
+// notBefore returns the earliest time a message from a retry topic may be processed
+func notBefore(message *sarama.ConsumerMessage) (time.Time, bool) {
+	value := kafkaHeaderCarrier(message.Headers).Get(headerRetryNotBefore)
+	if value == "" {
+		return time.Time{}, false
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(millis), true
+}
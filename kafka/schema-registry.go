@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+)
+
+// Schema types as reported by the Confluent schema registry
+const (
+	schemaTypeAvro     = "AVRO"
+	schemaTypeProtobuf = "PROTOBUF"
+)
+
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// ErrSchemaRegistryUnavailable marks a failure to fetch a schema that may succeed when tried again,
+// like a timeout or a server error of the registry
+var ErrSchemaRegistryUnavailable = errors.New("schema registry unavailable")
+
+// Schema is a writer schema referenced by the id in a Confluent wire format payload
+type Schema struct {
+	Id     int
+	Type   string
+	Schema string
+}
+
+// SchemaRegistry looks up writer schemas by their id
+type SchemaRegistry interface {
+	SchemaById(ctx context.Context, id int) (*Schema, error)
+}
+
+// newSchemaRegistry returns the registry configured under kafka.schema-registry.
+// A url selects the Confluent REST API, a dir selects the file backed registry used for tests and local development.
+func newSchemaRegistry(cfg *koanf.Koanf) (SchemaRegistry, error) {
+	if dir := cfg.String("kafka.schema-registry.dir"); dir != "" {
+		return &fileSchemaRegistry{dir: dir}, nil
+	}
+	registryUrl := cfg.String("kafka.schema-registry.url")
+	if registryUrl == "" {
+		return nil, errors.New("kafka.schema-registry.url or kafka.schema-registry.dir is required for encoding " + cfg.String("kafka.encoding"))
+	}
+	password, err := secret(cfg, "kafka.schema-registry.password")
+	if err != nil {
+		return nil, err
+	}
+	return &httpSchemaRegistry{
+		baseUrl:  strings.TrimRight(registryUrl, "/"),
+		username: cfg.String("kafka.schema-registry.username"),
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// httpSchemaRegistry is a client of the Confluent schema registry REST API.
+// Schemas are immutable once registered, so every schema is fetched only once.
+type httpSchemaRegistry struct {
+	baseUrl  string
+	username string
+	password string
+	client   *http.Client
+	cache    sync.Map
+}
+
+func (r *httpSchemaRegistry) SchemaById(ctx context.Context, id int) (*Schema, error) {
+	if cached, ok := r.cache.Load(id); ok {
+		return cached.(*Schema), nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseUrl+"/schemas/ids/"+url.PathEscape(strconv.Itoa(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		request.SetBasicAuth(r.username, r.password)
+	}
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSchemaRegistryUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: id %d", ErrSchemaNotFound, id)
+	}
+	if response.StatusCode >= http.StatusInternalServerError || response.StatusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("%w: registry returned %s for schema id %d", ErrSchemaRegistryUnavailable, response.Status, id)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry returned %s for schema id %d", response.Status, id)
+	}
+	var body struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&body); err != nil {
+		// a response cut off mid body is read again on the next try
+		return nil, fmt.Errorf("%w: could not read schema id %d: %w", ErrSchemaRegistryUnavailable, id, err)
+	}
+	schema := &Schema{Id: id, Type: body.SchemaType, Schema: body.Schema}
+	if schema.Type == "" {
+		// the registry leaves out the type for avro schemas
+		schema.Type = schemaTypeAvro
+	}
+	r.cache.Store(id, schema)
+	return schema, nil
+}
+
+// fileSchemaRegistry is a stand-in for the schema registry that reads schemas from a directory.
+// A schema with id 7 is stored as 7.avsc for avro or 7.proto for protobuf.
+type fileSchemaRegistry struct {
+	dir string
+}
+
+func (r *fileSchemaRegistry) SchemaById(ctx context.Context, id int) (*Schema, error) {
+	for extension, schemaType := range map[string]string{".avsc": schemaTypeAvro, ".proto": schemaTypeProtobuf} {
+		content, err := os.ReadFile(filepath.Join(r.dir, strconv.Itoa(id)+extension))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Id: id, Type: schemaType, Schema: string(content)}, nil
+	}
+	return nil, fmt.Errorf("%w: id %d in %s", ErrSchemaNotFound, id, r.dir)
+}
@@ -0,0 +1,118 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/knadh/koanf/v2"
+	"github.com/xdg-go/scram"
+)
+
+// configureTLS enables TLS on the client connection when kafka.tls.enabled is set
+func configureTLS(kafkaConfig *sarama.Config, cfg *koanf.Koanf) error {
+	if !cfg.Bool("kafka.tls.enabled") {
+		return nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.Bool("kafka.tls.insecure-skip-verify"),
+	}
+	if caFile := cfg.String("kafka.tls.ca-file"); caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("could not read kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return errors.New("no certificates found in kafka CA file " + caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile, keyFile := cfg.String("kafka.tls.cert-file"), cfg.String("kafka.tls.key-file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	kafkaConfig.Net.TLS.Enable = true
+	kafkaConfig.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+// configureSASL enables SASL authentication when kafka.sasl.enabled is set.
+// Supported mechanisms are PLAIN, SCRAM-SHA-256 and SCRAM-SHA-512.
+func configureSASL(kafkaConfig *sarama.Config, cfg *koanf.Koanf) error {
+	if !cfg.Bool("kafka.sasl.enabled") {
+		return nil
+	}
+	password, err := secret(cfg, "kafka.sasl.password")
+	if err != nil {
+		return err
+	}
+	kafkaConfig.Net.SASL.Enable = true
+	kafkaConfig.Net.SASL.Handshake = true
+	kafkaConfig.Net.SASL.User = cfg.String("kafka.sasl.username")
+	kafkaConfig.Net.SASL.Password = password
+	switch mechanism := strings.ToUpper(cfg.String("kafka.sasl.mechanism")); mechanism {
+	case "", sarama.SASLTypePlaintext:
+		kafkaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		kafkaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		kafkaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512.New}
+		}
+	default:
+		return errors.New("unsupported kafka SASL mechanism: " + mechanism)
+	}
+	return nil
+}
+
+// secret returns the value of key, or the content of the file named by key-file when it is set.
+// Loading from a file allows passwords to be mounted as secrets instead of being put in env variables.
+func secret(cfg *koanf.Koanf, key string) (string, error) {
+	if path := cfg.String(key + "-file"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s-file: %w", key, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return cfg.String(key), nil
+}
+
+// scramClient adapts the xdg-go scram client to sarama.SCRAMClient
+type scramClient struct {
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -13,6 +13,7 @@ import (
 	"go.opentelemetry.io/otel/metric"
 	"hangout.com/core/storage-service/config"
 	"hangout.com/core/storage-service/database"
+	"hangout.com/core/storage-service/exceptions"
 	"hangout.com/core/storage-service/files"
 	"hangout.com/core/storage-service/kafka"
 	"hangout.com/core/storage-service/logger"
@@ -60,21 +61,32 @@ func main() {
 	dbConnpool := database.ConnectToDB(ctx, CONFIG, log)
 	defer dbConnpool.Close(ctx, log)
 
+	// Start the Kafka producer used for retry, dead letter and outbox records
+	producer, err := kafka.NewProducer(ctx, CONFIG, log)
+	if err != nil {
+		exceptions.KafkaConnectError(ctx, "could not setup kafka producer", &err, log)
+	}
+	defer producer.Close(ctx)
+
+	// Start relaying status events written to the outbox
+	relay := kafka.StartOutboxRelay(ctx, producer, dbConnpool, CONFIG, log)
+
 	// Channel to handle incoming Kafka events
 	eventChan := make(chan *files.File, CONFIG.Int("process.queue-length"))
 
 	// Start the worker pool with the base context
 	log.Info(ctx, "Creating worker pool", "pool-strength", CONFIG.Int("process.queue-length"))
-	wp := worker.CreateWorkerPool(eventChan, ctx, CONFIG, dbConnpool, log)
+	wp := worker.CreateWorkerPool(eventChan, ctx, CONFIG, dbConnpool, producer, log)
 
 	// Start the Kafka consumer
-	err = kafka.StartConsumer(eventChan, ctx, CONFIG, log)
+	err = kafka.StartConsumer(eventChan, producer, ctx, CONFIG, log)
 	if err != nil {
 		log.Error(ctx, "Error starting Consumer Group")
 	}
 
 	// Wait for all workers to finish on shutdown
 	wp.Wait()
+	relay.Wait()
 	log.Info(ctx, "Hangout Storage Service shut down gracefully")
 }
 
@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -9,9 +10,17 @@ import (
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"hangout.com/core/storage-service/cloudstorage"
 	"hangout.com/core/storage-service/database"
+	"hangout.com/core/storage-service/database/model"
+	"hangout.com/core/storage-service/exceptions"
 	"hangout.com/core/storage-service/files"
+	"hangout.com/core/storage-service/files/command"
+	"hangout.com/core/storage-service/files/scheduler"
+	"hangout.com/core/storage-service/files/workspace"
+	"hangout.com/core/storage-service/kafka"
 	"hangout.com/core/storage-service/logger"
 )
 
@@ -21,11 +30,23 @@ type WorkerPool struct {
 	ctx        context.Context
 	cfg        *koanf.Koanf
 	dbConnPool *database.DatabaseConnectionPool
-	log        logger.Log
+	producer   *kafka.Producer
+	// slots limit the encodes running at the same time across all workers
+	slots *scheduler.Slots
+	// runner starts ffmpeg and ffprobe for the pipelines
+	runner command.Runner
+	log    logger.Log
 }
 
-func CreateWorkerPool(eventChan <-chan *files.File, ctx context.Context, cfg *koanf.Koanf, dbConnPool *database.DatabaseConnectionPool, log logger.Log) *WorkerPool {
-	wp := &WorkerPool{eventChan: eventChan, wg: &sync.WaitGroup{}, ctx: ctx, cfg: cfg, dbConnPool: dbConnPool, log: log}
+func CreateWorkerPool(eventChan <-chan *files.File, ctx context.Context, cfg *koanf.Koanf, dbConnPool *database.DatabaseConnectionPool, producer *kafka.Producer, log logger.Log) *WorkerPool {
+	wp := &WorkerPool{eventChan: eventChan, wg: &sync.WaitGroup{}, ctx: ctx, cfg: cfg, dbConnPool: dbConnPool, producer: producer, slots: scheduler.NewSlots(cfg), runner: command.Exec{}, log: log}
+	// no job runs yet, whatever is left in the work root belongs to a process that did not get to clean up
+	removed, err := workspace.Sweep(cfg)
+	if err != nil {
+		log.Error(ctx, "could not remove stale workspaces", "root", workspace.Root(cfg), "error", err.Error())
+	} else if len(removed) > 0 {
+		log.Info(ctx, "removed stale workspaces", "root", workspace.Root(cfg), "count", len(removed))
+	}
 	for i := 0; i < cfg.Int("process.pool-strength"); i++ {
 		log.Debug(ctx, "spawning worker", "worker-id", i)
 		wp.wg.Add(1)
@@ -57,8 +78,17 @@ func (worker *WorkerPool) worker(workerId int) {
 }
 
 func (worker *WorkerPool) do(workerId int, file *files.File, workerLogger logger.Log, s3Client *s3.Client) {
+	if file.Lease != nil {
+		if !file.Lease.Start() {
+			workerLogger.Info(file.Context, "partition was revoked before processing started, skipping", "file-name", file.Filename)
+			return
+		}
+		defer file.Lease.Finish()
+	}
+	jobCtx, cancel := worker.jobContext(file.Context)
+	defer cancel()
 	tr := otel.Tracer("hangout.storage.worker")
-	ctx, span := tr.Start(file.Context, "ProcessFile")
+	ctx, span := tr.Start(jobCtx, "ProcessFile")
 	span.SetAttributes(
 		attribute.Int("worker.id", workerId),
 		attribute.String("file.name", file.Filename),
@@ -72,31 +102,159 @@ func (worker *WorkerPool) do(workerId int, file *files.File, workerLogger logger
 	isProcessed, err := worker.dbConnPool.IsAlreadyProcessed(ctx, file.Filename)
 	if err != nil {
 		workerLogger.Error(ctx, "error checking process status", "error", err.Error())
-		// Optionally: do not acknowledge, so it can be retried
+		worker.fail(ctx, workerId, file, exceptions.NewStageError(exceptions.StageStatusCheck, "", err), workerLogger)
 		return
 	}
 	if isProcessed {
 		workerLogger.Info(ctx, "file already processed, acknowledging and skipping", "file-name", file.Filename)
-		if file.KafkaSession != nil && file.KafkaMessage != nil {
-			file.KafkaSession.MarkMessage(file.KafkaMessage, "")
-		}
+		acknowledge(file)
 		return
 	}
 
 	// Not processed: download, process, upload, then acknowledge
-	cloudstorage.Download(ctx, s3Client, file, worker.cfg, workerLogger)
-	err = file.Process(ctx, worker.cfg, worker.dbConnPool, workerLogger)
+	file.Workspace, err = workspace.New(worker.cfg, file.Filename)
+	if err != nil {
+		workerLogger.Error(ctx, "could not create workspace", "error", err.Error())
+		err = exceptions.NewStageError(exceptions.StageAdmission, "workspace", err)
+		worker.markFailed(ctx, file, err, workerLogger)
+		worker.fail(ctx, workerId, file, err, workerLogger)
+		return
+	}
+	// deferred calls also run while a panic unwinds the worker, so the workspace never outlives the job
+	defer func() {
+		if err := file.Workspace.Remove(); err != nil {
+			workerLogger.Error(ctx, "could not remove workspace", "directory", file.Workspace.Dir(), "error", err.Error())
+		}
+	}()
+	file.Slots = worker.slots
+	file.Runner = worker.runner
+	err = cloudstorage.Download(ctx, s3Client, file, worker.cfg, workerLogger)
+	if err == nil {
+		err = file.Process(ctx, worker.cfg, worker.dbConnPool, workerLogger)
+	}
+	if err == nil && isInterrupted(ctx) {
+		// nothing has been uploaded yet, the next owner of the partition starts over
+		worker.abandon(ctx, file, workerLogger)
+		return
+	}
+	if err == nil {
+		err = cloudstorage.UploadDir(ctx, s3Client, file, worker.cfg, workerLogger)
+	}
+	if err != nil {
+		workerLogger.Error(ctx, "could not process file", "stage", exceptions.StageOf(err), "error", err.Error())
+		worker.markFailed(ctx, file, err, workerLogger)
+		worker.fail(ctx, workerId, file, err, workerLogger)
+		return
+	}
+	workerLogger.Info(ctx, "marking file status as SUCCESS in db", "filename", file.Filename)
+	// the upload has finished, so the result is recorded even if the job was interrupted in the meantime
+	err = file.UpdateStatus(context.WithoutCancel(ctx), worker.cfg, worker.dbConnPool, model.SUCCESS, "", nil, workerLogger)
 	if err != nil {
-		workerLogger.Error(ctx, "could not process file", "error", err.Error())
-		// Optionally: do not acknowledge, so it can be retried
+		workerLogger.Error(ctx, "could not mark file as SUCCESS in db", "file-name", file.Filename, "error", err.Error())
+		worker.fail(ctx, workerId, file, exceptions.NewStageError(exceptions.StageStatusUpdate, "", err), workerLogger)
 		return
 	}
+	acknowledge(file)
+	workerLogger.Info(ctx, "finished file processing", "file-name", file.Filename)
+}
 
-	cloudstorage.UploadDir(ctx, s3Client, file, worker.cfg, workerLogger)
+// jobContext bounds the processing of a single file by process.job-timeout
+func (worker *WorkerPool) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	limit := worker.cfg.Duration("process.job-timeout")
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, limit, &exceptions.TimeoutError{Scope: "job", Limit: limit})
+}
+
+// markFailed moves a file whose processing failed in one of its stages to FAIL.
+// Interrupted jobs are left alone, abandon puts them back in the queue instead.
+func (worker *WorkerPool) markFailed(ctx context.Context, file *files.File, cause error, workerLogger logger.Log) {
+	if isInterrupted(ctx) {
+		return
+	}
+	var stageErr *exceptions.StageError
+	if errors.As(cause, &stageErr) && stageErr.Stderr != "" {
+		workerLogger.Debug(ctx, "stderr of failed stage", "stage", stageErr.Stage, "exit-code", stageErr.ExitCode, "stderr", stageErr.Stderr)
+	}
+	workerLogger.Info(ctx, "marking file status as FAILED in db", "filename", file.Filename)
+	// the job may have been cancelled by its timeout, the status still has to be written
+	err := file.UpdateStatus(context.WithoutCancel(ctx), worker.cfg, worker.dbConnPool, model.FAIL, string(exceptions.StageOf(cause)), cause, workerLogger)
+	if err != nil {
+		workerLogger.Error(ctx, "could not mark file as FAILED in db", "file-name", file.Filename, "error", err.Error())
+	}
+}
+
+// fail hands a file event that could not be processed back to kafka and acknowledges it.
+// Transient failures are scheduled on the next retry topic, permanent ones go straight to the dead letter topic.
+// If the event can not be handed back it is left unacknowledged so that it is redelivered.
+func (worker *WorkerPool) fail(ctx context.Context, workerId int, file *files.File, cause error, workerLogger logger.Log) {
+	if isInterrupted(ctx) {
+		worker.abandon(ctx, file, workerLogger)
+		return
+	}
+	if file.KafkaMessage == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(cause)
+	span.SetStatus(codes.Error, cause.Error())
+	stage := exceptions.StageOf(cause)
+	if stage == "" {
+		stage = exceptions.StageProcess
+	}
+	failure := kafka.Failure{Stage: string(stage), Err: cause, WorkerId: workerId}
+	var err error
+	if isRetryable(cause) {
+		err = worker.producer.Retry(ctx, file.KafkaMessage, failure)
+	} else {
+		err = worker.producer.PublishDeadLetter(ctx, file.KafkaMessage, failure)
+	}
+	if err != nil {
+		workerLogger.Error(ctx, "could not hand file event back to kafka, leaving it unacknowledged", "file-name", file.Filename, "error", err)
+		return
+	}
+	acknowledge(file)
+}
+
+// abandon gives up on a file whose partition was revoked during a rebalance or that was interrupted by
+// a shutdown. The file goes back to IN_QUEUE and its event stays unacknowledged, so that whoever owns the
+// partition next processes it again.
+func (worker *WorkerPool) abandon(ctx context.Context, file *files.File, workerLogger logger.Log) {
+	cause := context.Cause(ctx)
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("job.abandoned")
+	span.SetStatus(codes.Error, cause.Error())
+	workerLogger.Warn(ctx, "processing was interrupted, handing the file over", "file-name", file.Filename, "reason", cause.Error())
+	// the job context is cancelled at this point
+	ctx = context.WithoutCancel(ctx)
+	err := file.UpdateStatus(ctx, worker.cfg, worker.dbConnPool, model.IN_QUEUE, "interrupted", cause, workerLogger)
+	if err != nil {
+		workerLogger.Error(ctx, "could not mark abandoned file as IN_QUEUE", "file-name", file.Filename, "error", err)
+	}
+}
+
+// isInterrupted reports whether the job was cancelled because its partition was revoked or the service is shutting down
+func isInterrupted(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, kafka.ErrPartitionRevoked) || errors.Is(cause, context.Canceled)
+}
+
+// isRetryable reports whether processing the file again later might succeed
+func isRetryable(err error) bool {
+	return !exceptions.IsPermanent(err) && !errors.Is(err, files.ErrUnsupportedContentType)
+}
+
+// acknowledge marks the kafka message of the file as consumed. The lease only commits the offset once
+// the events before it are done, so that an abandoned or unacknowledged event is never skipped.
+func acknowledge(file *files.File) {
+	if file.Lease != nil {
+		file.Lease.Acknowledge()
+		return
+	}
 	if file.KafkaSession != nil && file.KafkaMessage != nil {
 		file.KafkaSession.MarkMessage(file.KafkaMessage, "")
 	}
-	workerLogger.Info(ctx, "finished file processing", "file-name", file.Filename)
 }
 
 // Wait ensures all workers complete processing before the program exits